@@ -0,0 +1,72 @@
+package backend
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrNodeExists = errors.New("node already exists")
+
+// actions of Event
+const (
+	ActionCreate = "create"
+	ActionSet    = "set"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+	// ActionResync is sent when changes may have been lost, the receiver
+	// should re-list the keys under Event.Key.
+	ActionResync = "resync"
+)
+
+const (
+	BackoffMin = 1 * time.Second
+	BackoffMax = 30 * time.Second
+)
+
+// Event is a change of a key, every driver translates its own
+// notifications into it.
+type Event struct {
+	Action string
+	Key    string
+	Value  string
+	Dir    bool
+	Index  uint64 // increases with every change seen by the driver
+}
+
+// Backend is a key tree watched by watcher, keys are slash separated
+// paths like "/watcher/web01/a.com/config".
+type Backend interface {
+	Mkdir(dir string) error
+	// Create fails with ErrNodeExists when the key exists.
+	Create(path string, data []byte) error
+	Update(path string, data []byte) error
+	Delete(path string, recursive bool) error
+	// Read returns nil when the key doesn't exist or is a directory.
+	Read(path string) ([]byte, error)
+	// List returns the keys of the direct children of path.
+	List(path string) ([]string, error)
+	// Index returns an index not lower than the one of the last change
+	// under path, to start a watch after it.
+	Index(path string) (uint64, error)
+	// Watch sends every change under path to evCh until exitCh is closed,
+	// it must keep going over errors.
+	Watch(path string, evCh chan *Event, exitCh chan bool)
+	// WatchAfter is Watch starting after index, returned by Index before
+	// reading the keys, so that no change is lost in between. A driver
+	// which can't replay the changes sends an ActionResync event when
+	// there are any. 0 starts at the current index.
+	WatchAfter(path string, index uint64, evCh chan *Event, exitCh chan bool)
+	Close() error
+}
+
+// NextBackoff doubles backoff between BackoffMin and BackoffMax.
+func NextBackoff(backoff time.Duration) time.Duration {
+	if backoff < BackoffMin {
+		return BackoffMin
+	}
+	backoff *= 2
+	if backoff > BackoffMax {
+		backoff = BackoffMax
+	}
+	return backoff
+}
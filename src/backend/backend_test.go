@@ -0,0 +1,20 @@
+package backend
+
+import (
+	"testing"
+)
+
+func TestNextBackoff(t *testing.T) {
+	backoff := NextBackoff(0)
+	if backoff != BackoffMin {
+		t.Fatalf("test NextBackoff failed, %v<-->%v", backoff, BackoffMin)
+	}
+	backoff = NextBackoff(backoff)
+	if backoff != 2*BackoffMin {
+		t.Fatalf("test NextBackoff failed, %v<-->%v", backoff, 2*BackoffMin)
+	}
+	backoff = NextBackoff(BackoffMax)
+	if backoff != BackoffMax {
+		t.Fatalf("test NextBackoff failed, %v<-->%v", backoff, BackoffMax)
+	}
+}
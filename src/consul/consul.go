@@ -0,0 +1,407 @@
+package consul
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"backend"
+	"utils/xlog"
+)
+
+var ErrClosedConsulClient = errors.New("use of closed consul client")
+
+var (
+	// WatchWait is the longest time a blocking query is held by consul
+	WatchWait = 5 * time.Minute
+)
+
+// kvPair is an entry of the consul KV api, Value is base64 in json.
+type kvPair struct {
+	Key         string
+	Value       []byte
+	CreateIndex uint64
+	ModifyIndex uint64
+}
+
+// ConsulClient talks to the consul KV http api, keys are stored without
+// the leading slash and directories are the "<dir>/" prefix of the keys.
+type ConsulClient struct {
+	sync.Mutex
+	// the agents of endpoints, requests go to addrs[cur] and fail over to
+	// the next one when it can't be reached
+	addrs  []string
+	cur    int
+	token  string
+	client *http.Client
+
+	closed  bool
+	timeout time.Duration
+}
+
+func New(endpoints string, timeout time.Duration, token string) (*ConsulClient, error) {
+	var addrs []string
+	for _, addr := range strings.Split(endpoints, ",") {
+		addr = strings.TrimSpace(addr)
+		if len(addr) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+			addr = "http://" + addr
+		}
+		addrs = append(addrs, strings.TrimSuffix(addr, "/"))
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("consul: address is null")
+	}
+	return &ConsulClient{
+		addrs:   addrs,
+		token:   token,
+		client:  &http.Client{},
+		timeout: timeout,
+	}, nil
+}
+
+func (c *ConsulClient) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *ConsulClient) isClosed() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.closed
+}
+
+func kvKey(path string) string {
+	return strings.TrimPrefix(path, "/")
+}
+
+func dirKey(path string) string {
+	return strings.TrimSuffix(kvKey(path), "/") + "/"
+}
+
+func (c *ConsulClient) addr() (int, string) {
+	c.Lock()
+	defer c.Unlock()
+	return c.cur, c.addrs[c.cur]
+}
+
+// failover moves to the agent after cur, unless another request already
+// moved away from it.
+func (c *ConsulClient) failover(cur int) {
+	c.Lock()
+	defer c.Unlock()
+	if c.cur == cur {
+		c.cur = (cur + 1) % len(c.addrs)
+	}
+}
+
+// do sends a request to /v1/kv/<key>, a 404 is returned as a nil body. An
+// agent which can't be reached is left for the next one of endpoints.
+func (c *ConsulClient) do(ctx context.Context, method, key string, query url.Values, body []byte, timeout time.Duration) (data []byte, header http.Header, err error) {
+	for i := 0; i < len(c.addrs); i++ {
+		if c.isClosed() {
+			return nil, nil, ErrClosedConsulClient
+		}
+		cur, addr := c.addr()
+		var resp *http.Response
+		resp, err = c.send(ctx, addr, method, key, query, body, timeout)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			xlog.Warn("consul: %v is unreachable, err:%v", addr, err)
+			c.failover(cur)
+			continue
+		}
+		return c.read(resp, method, key)
+	}
+	return
+}
+
+func (c *ConsulClient) send(ctx context.Context, addr, method, key string, query url.Values, body []byte, timeout time.Duration) (*http.Response, error) {
+	u := fmt.Sprintf("%s/v1/kv/%s", addr, key)
+	if len(query) > 0 {
+		u = u + "?" + query.Encode()
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if len(c.token) > 0 {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+
+	client := *c.client
+	client.Timeout = timeout
+	return client.Do(req)
+}
+
+func (c *ConsulClient) read(resp *http.Response, method, key string) ([]byte, http.Header, error) {
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, resp.Header, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("consul: %s %s is err, err: %v %s", method, key, resp.Status, data)
+	}
+	return data, resp.Header, nil
+}
+
+func (c *ConsulClient) Mkdir(dir string) error {
+	if dir == "" || dir == "/" {
+		return nil
+	}
+	_, _, err := c.do(context.Background(), "PUT", dirKey(dir), nil, []byte{}, c.timeout)
+	return err
+}
+
+func (c *ConsulClient) Create(path string, data []byte) error {
+	query := url.Values{"cas": {"0"}}
+	ret, _, err := c.do(context.Background(), "PUT", kvKey(path), query, data, c.timeout)
+	if err != nil {
+		xlog.Debug("consul create node %s failed: %s", path, err)
+		return err
+	}
+	if strings.TrimSpace(string(ret)) != "true" {
+		return backend.ErrNodeExists
+	}
+	xlog.Debug("consul create node %s OK", path)
+	return nil
+}
+
+func (c *ConsulClient) Update(path string, data []byte) error {
+	_, _, err := c.do(context.Background(), "PUT", kvKey(path), nil, data, c.timeout)
+	if err != nil {
+		xlog.Debug("consul update node %s failed: %s", path, err)
+		return err
+	}
+	xlog.Debug("consul update node %s OK", path)
+	return nil
+}
+
+func (c *ConsulClient) Delete(path string, recursive bool) error {
+	_, _, err := c.do(context.Background(), "DELETE", kvKey(path), nil, nil, c.timeout)
+	if err == nil && recursive {
+		_, _, err = c.do(context.Background(), "DELETE", dirKey(path), url.Values{"recurse": {""}}, nil, c.timeout)
+	}
+	if err != nil {
+		xlog.Debug("consul delete node %s failed: %s", path, err)
+		return err
+	}
+	xlog.Debug("consul delete node %s OK", path)
+	return nil
+}
+
+func (c *ConsulClient) Read(path string) ([]byte, error) {
+	xlog.Debug("consul read node %s", path)
+	if strings.HasSuffix(path, "/") {
+		return nil, nil
+	}
+	data, _, err := c.do(context.Background(), "GET", kvKey(path), nil, nil, c.timeout)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var pairs []*kvPair
+	err = json.Unmarshal(data, &pairs)
+	if err != nil {
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	if pairs[0].Value == nil {
+		return []byte{}, nil
+	}
+	return pairs[0].Value, nil
+}
+
+func (c *ConsulClient) List(path string) ([]string, error) {
+	xlog.Debug("consul list node %s", path)
+	prefix := dirKey(path)
+	query := url.Values{"keys": {""}, "separator": {"/"}}
+	data, _, err := c.do(context.Background(), "GET", prefix, query, nil, c.timeout)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var keys []string
+	err = json.Unmarshal(data, &keys)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, key := range keys {
+		if key == prefix {
+			continue
+		}
+		files = append(files, "/"+strings.TrimSuffix(key, "/"))
+	}
+	return files, nil
+}
+
+// list returns every pair under the directory path with the index of the
+// response, it blocks until the index changes when index > 0.
+func (c *ConsulClient) list(ctx context.Context, path string, index uint64) (map[string]*kvPair, uint64, error) {
+	query := url.Values{"recurse": {""}}
+	timeout := c.timeout
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", fmt.Sprintf("%ds", int(WatchWait.Seconds())))
+		// consul adds up to wait/16 of jitter
+		timeout = WatchWait + WatchWait/16 + c.timeout
+	}
+	data, header, err := c.do(ctx, "GET", dirKey(path), query, nil, timeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	newIndex, err := strconv.ParseUint(header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("consul: bad X-Consul-Index, err: %v", err)
+	}
+	pairs := make(map[string]*kvPair)
+	if data == nil {
+		return pairs, newIndex, nil
+	}
+	var list []*kvPair
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, pair := range list {
+		pairs[pair.Key] = pair
+	}
+	return pairs, newIndex, nil
+}
+
+// diff returns the events turning the old pairs into the new ones.
+func diff(old, new map[string]*kvPair, index uint64) []*backend.Event {
+	var evs []*backend.Event
+	for key, pair := range new {
+		ev := &backend.Event{
+			Key:   "/" + strings.TrimSuffix(key, "/"),
+			Value: string(pair.Value),
+			Dir:   strings.HasSuffix(key, "/"),
+			Index: pair.ModifyIndex,
+		}
+		if oldPair, ok := old[key]; !ok {
+			ev.Action = backend.ActionCreate
+		} else if oldPair.ModifyIndex != pair.ModifyIndex {
+			ev.Action = backend.ActionSet
+		} else {
+			continue
+		}
+		evs = append(evs, ev)
+	}
+	for key := range old {
+		if _, ok := new[key]; !ok {
+			evs = append(evs, &backend.Event{
+				Action: backend.ActionDelete,
+				Key:    "/" + strings.TrimSuffix(key, "/"),
+				Dir:    strings.HasSuffix(key, "/"),
+				Index:  index,
+			})
+		}
+	}
+	sort.Slice(evs, func(i, j int) bool {
+		if evs[i].Index != evs[j].Index {
+			return evs[i].Index < evs[j].Index
+		}
+		return evs[i].Key < evs[j].Key
+	})
+	return evs
+}
+
+// Index returns the index of the last change under the directory path.
+func (c *ConsulClient) Index(path string) (uint64, error) {
+	_, index, err := c.list(context.Background(), path, 0)
+	return index, err
+}
+
+// Watch runs blocking queries on the directory path and sends the
+// difference between two results as events until exitCh is closed.
+func (c *ConsulClient) Watch(path string, evCh chan *backend.Event, exitCh chan bool) {
+	c.WatchAfter(path, 0, evCh, exitCh)
+}
+
+// WatchAfter is Watch sending a backend.ActionResync event first when the
+// directory changed after afterIndex, the changes aren't replayed.
+func (c *ConsulClient) WatchAfter(path string, afterIndex uint64, evCh chan *backend.Event, exitCh chan bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelRoutine := make(chan bool)
+	defer close(cancelRoutine)
+
+	go func() {
+		select {
+		case <-exitCh:
+			cancel()
+		case <-cancelRoutine:
+			return
+		}
+	}()
+
+	var (
+		pairs   map[string]*kvPair
+		index   uint64
+		backoff time.Duration
+	)
+	for {
+		newPairs, newIndex, err := c.list(ctx, path, index)
+		if err != nil {
+			if ctx.Err() != nil || c.isClosed() {
+				return
+			}
+			backoff = backend.NextBackoff(backoff)
+			xlog.Warn("consul watch %s failed, retry after %v: %v", path, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-exitCh:
+				return
+			}
+			continue
+		}
+		backoff = 0
+
+		var evs []*backend.Event
+		if pairs != nil {
+			evs = diff(pairs, newPairs, newIndex)
+		} else if afterIndex > 0 && newIndex > afterIndex {
+			evs = []*backend.Event{{Action: backend.ActionResync, Key: path, Dir: true, Index: newIndex}}
+		}
+		for _, ev := range evs {
+			select {
+			case evCh <- ev:
+			case <-exitCh:
+				return
+			}
+		}
+		pairs = newPairs
+		// the index must be reset when it goes backwards
+		if newIndex < index {
+			newIndex = 0
+		}
+		index = newIndex
+	}
+}
@@ -0,0 +1,260 @@
+package consul
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"backend"
+)
+
+// fakeKV is a stand-in for the consul KV http api.
+type fakeKV struct {
+	sync.Mutex
+	cond  *sync.Cond
+	index uint64
+	pairs map[string]*kvPair
+}
+
+func newFakeKV() *fakeKV {
+	kv := &fakeKV{index: 1, pairs: make(map[string]*kvPair)}
+	kv.cond = sync.NewCond(kv)
+	return kv
+}
+
+func (kv *fakeKV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	query := r.URL.Query()
+	kv.Lock()
+	defer kv.Unlock()
+
+	switch r.Method {
+	case "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		if query.Get("cas") == "0" && kv.pairs[key] != nil {
+			w.Write([]byte("false"))
+			return
+		}
+		kv.index++
+		pair := &kvPair{Key: key, Value: body, CreateIndex: kv.index, ModifyIndex: kv.index}
+		if old := kv.pairs[key]; old != nil {
+			pair.CreateIndex = old.CreateIndex
+		}
+		kv.pairs[key] = pair
+		kv.cond.Broadcast()
+		w.Write([]byte("true"))
+	case "DELETE":
+		_, recurse := query["recurse"]
+		for k := range kv.pairs {
+			if k == key || (recurse && strings.HasPrefix(k, key)) {
+				delete(kv.pairs, k)
+			}
+		}
+		kv.index++
+		kv.cond.Broadcast()
+		w.Write([]byte("true"))
+	case "GET":
+		if index, err := strconv.ParseUint(query.Get("index"), 10, 64); err == nil {
+			for kv.index <= index {
+				kv.cond.Wait()
+			}
+		}
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(kv.index, 10))
+
+		_, recurse := query["recurse"]
+		_, keysOnly := query["keys"]
+		var list []*kvPair
+		var keys []string
+		seen := make(map[string]bool)
+		for k, pair := range kv.pairs {
+			if !recurse && !keysOnly {
+				if k == key {
+					list = append(list, pair)
+				}
+				continue
+			}
+			if !strings.HasPrefix(k, key) {
+				continue
+			}
+			list = append(list, pair)
+			name := k
+			if sep := query.Get("separator"); len(sep) > 0 {
+				if i := strings.Index(k[len(key):], sep); i >= 0 {
+					name = k[:len(key)+i+1]
+				}
+			}
+			if !seen[name] {
+				seen[name] = true
+				keys = append(keys, name)
+			}
+		}
+		if len(list) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if keysOnly {
+			sort.Strings(keys)
+			json.NewEncoder(w).Encode(keys)
+			return
+		}
+		json.NewEncoder(w).Encode(list)
+	}
+}
+
+func newTestClient(t *testing.T) (*ConsulClient, func()) {
+	ts := httptest.NewServer(newFakeKV())
+	c, err := New(ts.URL, time.Minute, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, func() {
+		c.Close()
+		ts.Close()
+	}
+}
+
+func TestCreateReadList(t *testing.T) {
+	c, done := newTestClient(t)
+	defer done()
+
+	path := "/ker-unittest/dir/file"
+	err := c.Create(path, []byte("unittest1"))
+	if err != nil {
+		t.Fatalf("test Create failed, %v", err)
+	}
+	err = c.Create(path, []byte("unittest1"))
+	if err != backend.ErrNodeExists {
+		t.Fatalf("test Create failed, %v", err)
+	}
+	err = c.Update(path, []byte("unittest2"))
+	if err != nil {
+		t.Fatalf("test Update failed, %v", err)
+	}
+
+	b, err := c.Read(path)
+	if err != nil {
+		t.Fatalf("test read failed, %v", err)
+	}
+	if string(b) != "unittest2" {
+		t.Fatalf("test read failed, not expected data, %s<-->%s", string(b), "unittest2")
+	}
+	b, err = c.Read("/ker-unittest/dir/none")
+	if err != nil || b != nil {
+		t.Fatalf("test read failed, %v %v", b, err)
+	}
+
+	data, err := c.List("/ker-unittest")
+	if err != nil {
+		t.Fatalf("test list failed, %v", err)
+	}
+	if len(data) != 1 || data[0] != "/ker-unittest/dir" {
+		t.Fatalf("test list failed, not expected data, %v", data)
+	}
+
+	err = c.Delete("/ker-unittest", true)
+	if err != nil {
+		t.Fatalf("test delete failed, %v", err)
+	}
+	b, err = c.Read(path)
+	if err != nil || b != nil {
+		t.Fatalf("test delete failed, %v %v", b, err)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	ts := httptest.NewServer(newFakeKV())
+	defer ts.Close()
+	// nothing listens on the first agent
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	c, err := New(down.URL+","+ts.URL, time.Minute, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	path := "/ker-unittest/failover"
+	err = c.Create(path, []byte("unittest"))
+	if err != nil {
+		t.Fatalf("test failover failed, %v", err)
+	}
+	b, err := c.Read(path)
+	if err != nil || string(b) != "unittest" {
+		t.Fatalf("test failover failed, %s %v", b, err)
+	}
+	if _, addr := c.addr(); addr != ts.URL {
+		t.Fatalf("test failover failed, not expected agent, %v", addr)
+	}
+
+	ts.Close()
+	if _, err = c.Read(path); err == nil {
+		t.Fatal("test failover failed, no err when all agents are down")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	c, done := newTestClient(t)
+	defer done()
+
+	path := "/ker-unittest/dir"
+	ch := make(chan *backend.Event, 10)
+	exitCh := make(chan bool)
+	defer close(exitCh)
+	go c.Watch(path, ch, exitCh)
+	time.Sleep(100 * time.Millisecond)
+
+	steps := []struct {
+		op     func()
+		action string
+		value  string
+	}{
+		{func() { c.Update(path+"/file", []byte("unittest1")) }, backend.ActionCreate, "unittest1"},
+		{func() { c.Update(path+"/file", []byte("unittest2")) }, backend.ActionSet, "unittest2"},
+		{func() { c.Delete(path+"/file", false) }, backend.ActionDelete, ""},
+	}
+	for _, step := range steps {
+		step.op()
+		select {
+		case ev := <-ch:
+			if ev.Action != step.action || ev.Key != path+"/file" || ev.Value != step.value {
+				t.Fatalf("test watch failed, not expected event, %+v", ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("test watch failed, no event for %v", step.action)
+		}
+	}
+}
+
+func TestWatchAfter(t *testing.T) {
+	c, done := newTestClient(t)
+	defer done()
+
+	path := "/ker-unittest/dir"
+	c.Update(path+"/file", []byte("unittest1"))
+	index, err := c.Index(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// changed before the watch started
+	c.Update(path+"/file", []byte("unittest2"))
+
+	ch := make(chan *backend.Event, 10)
+	exitCh := make(chan bool)
+	defer close(exitCh)
+	go c.WatchAfter(path, index, ch, exitCh)
+	select {
+	case ev := <-ch:
+		if ev.Action != backend.ActionResync || ev.Key != path || ev.Index <= index {
+			t.Fatalf("test watch after failed, not expected event, %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("test watch after failed, no resync")
+	}
+}
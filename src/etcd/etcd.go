@@ -3,45 +3,86 @@ package etcd
 import (
 	"context"
 	"errors"
-	"strings"
+	"fmt"
 	"sync"
 	"time"
 
-	"github.com/coreos/etcd/client"
-	//client "github.com/coreos/etcd/clientv3"
+	"backend"
 	"utils/xlog"
 )
 
 var ErrClosedEtcdClient = errors.New("use of closed etcd client")
 
+const (
+	APIv2 = "v2"
+	APIv3 = "v3"
+)
+
+// keysAPI is implemented by the v2 and v3 protocols.
+type keysAPI interface {
+	mkdir(ctx context.Context, dir string) error
+	create(ctx context.Context, path string, data []byte) error
+	// createEphemeral creates a key which lives as long as the client.
+	createEphemeral(ctx context.Context, path string, data []byte) error
+	update(ctx context.Context, path string, data []byte) error
+	delete(ctx context.Context, path string, recursive bool) error
+	read(ctx context.Context, path string) ([]byte, error)
+	list(ctx context.Context, path string) ([]string, error)
+	// index returns the current index of the store.
+	index(ctx context.Context, path string) (uint64, error)
+	// watch sends events after afterIndex to evCh until an error occurs,
+	// it returns the index of the last event sent.
+	watch(ctx context.Context, path string, afterIndex uint64, evCh chan *backend.Event) (uint64, error)
+	close() error
+}
+
+// indexClearedError is returned by watch when the events after the
+// requested index are no longer available.
+type indexClearedError struct {
+	index uint64 // current index to resume from
+}
+
+func (e *indexClearedError) Error() string {
+	return fmt.Sprintf("etcd event index cleared, current index %v", e.index)
+}
+
 type EtcdClient struct {
 	sync.Mutex
-	kapi client.KeysAPI
+	api keysAPI
 
 	closed  bool
 	timeout time.Duration
 }
 
-func New(addr string, timeout time.Duration, username, passwd string) (*EtcdClient, error) {
-	endpoints := strings.Split(addr, ",")
-	for i, s := range endpoints {
-		if s != "" && !strings.HasPrefix(s, "http://") {
-			endpoints[i] = "http://" + s
-		}
+func New(api, addr string, timeout time.Duration, username, passwd string) (*EtcdClient, error) {
+	return NewWithTLS(api, addr, timeout, username, passwd, TLSConfig{})
+}
+
+// NewWithTLS connects to the endpoints of addr, comma separated, with the
+// tls config. The endpoints without a scheme use https when tls is set.
+func NewWithTLS(api, addr string, timeout time.Duration, username, passwd string, tlsCfg TLSConfig) (*EtcdClient, error) {
+	endpoints, err := normalizeEndpoints(addr, tlsCfg)
+	if err != nil {
+		return nil, err
 	}
-	config := client.Config{
-		Endpoints:               endpoints,
-		Transport:               client.DefaultTransport,
-		Username:                username,
-		Password:                passwd,
-		HeaderTimeoutPerRequest: time.Second * 3,
+	tlsConfig, err := tlsCfg.config(endpoints)
+	if err != nil {
+		return nil, err
+	}
+	var kapi keysAPI
+	switch api {
+	case APIv2, "":
+		kapi, err = newV2(endpoints, tlsConfig, username, passwd)
+	case APIv3:
+		kapi, err = newV3(endpoints, tlsConfig, timeout, username, passwd)
+	default:
+		err = fmt.Errorf("etcd: unknown api version %v", api)
 	}
-	c, err := client.New(config)
 	if err != nil {
 		return nil, err
 	}
 	return &EtcdClient{
-		kapi: client.NewKeysAPI(c), timeout: timeout,
+		api: kapi, timeout: timeout,
 	}, nil
 }
 
@@ -52,7 +93,7 @@ func (c *EtcdClient) Close() error {
 		return nil
 	}
 	c.closed = true
-	return nil
+	return c.api.close()
 }
 
 func (c *EtcdClient) contextWithTimeout() (context.Context, context.CancelFunc) {
@@ -63,47 +104,18 @@ func (c *EtcdClient) contextWithTimeout() (context.Context, context.CancelFunc)
 	}
 }
 
-func isErrNoNode(err error) bool {
-	if err != nil {
-		if e, ok := err.(client.Error); ok {
-			return e.Code == client.ErrorCodeKeyNotFound
-		}
-	}
-	return false
-}
-
-func isErrNodeExists(err error) bool {
-	if err != nil {
-		if e, ok := err.(client.Error); ok {
-			return e.Code == client.ErrorCodeNodeExist
-		}
-	}
-	return false
-}
-
 func (c *EtcdClient) Mkdir(dir string) error {
 	c.Lock()
 	defer c.Unlock()
 	if c.closed {
 		return ErrClosedEtcdClient
 	}
-	return c.mkdir(dir)
-}
-
-func (c *EtcdClient) mkdir(dir string) error {
 	if dir == "" || dir == "/" {
 		return nil
 	}
 	cntx, canceller := c.contextWithTimeout()
 	defer canceller()
-	_, err := c.kapi.Set(cntx, dir, "", &client.SetOptions{Dir: true, PrevExist: client.PrevNoExist})
-	if err != nil {
-		if isErrNodeExists(err) {
-			return nil
-		}
-		return err
-	}
-	return nil
+	return c.api.mkdir(cntx, dir)
 }
 
 func (c *EtcdClient) Create(path string, data []byte) error {
@@ -115,7 +127,7 @@ func (c *EtcdClient) Create(path string, data []byte) error {
 	c.Unlock()
 	cntx, canceller := c.contextWithTimeout()
 	defer canceller()
-	_, err := c.kapi.Set(cntx, path, string(data), &client.SetOptions{PrevExist: client.PrevNoExist})
+	err := c.api.create(cntx, path, data)
 	if err != nil {
 		xlog.Debug("etcd create node %s failed: %s", path, err)
 		return err
@@ -124,6 +136,27 @@ func (c *EtcdClient) Create(path string, data []byte) error {
 	return nil
 }
 
+// CreateEphemeral creates path like Create, the key is removed by etcd
+// when the client is closed or stops keeping it alive. It needs the v3
+// api, the keys are put with a lease of LeaseTTL seconds.
+func (c *EtcdClient) CreateEphemeral(path string, data []byte) error {
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return ErrClosedEtcdClient
+	}
+	c.Unlock()
+	cntx, canceller := c.contextWithTimeout()
+	defer canceller()
+	err := c.api.createEphemeral(cntx, path, data)
+	if err != nil {
+		xlog.Debug("etcd create ephemeral node %s failed: %s", path, err)
+		return err
+	}
+	xlog.Debug("etcd create ephemeral node %s OK", path)
+	return nil
+}
+
 func (c *EtcdClient) Update(path string, data []byte) error {
 	c.Lock()
 	//defer c.Unlock()
@@ -133,7 +166,7 @@ func (c *EtcdClient) Update(path string, data []byte) error {
 	c.Unlock()
 	cntx, canceller := c.contextWithTimeout()
 	defer canceller()
-	_, err := c.kapi.Set(cntx, path, string(data), &client.SetOptions{PrevExist: client.PrevIgnore})
+	err := c.api.update(cntx, path, data)
 	if err != nil {
 		xlog.Debug("etcd update node %s failed: %s", path, err)
 		return err
@@ -142,7 +175,7 @@ func (c *EtcdClient) Update(path string, data []byte) error {
 	return nil
 }
 
-func (c *EtcdClient) Delete(path string, opts *client.DeleteOptions) error {
+func (c *EtcdClient) Delete(path string, recursive bool) error {
 	c.Lock()
 	//defer c.Unlock()
 	if c.closed {
@@ -151,8 +184,8 @@ func (c *EtcdClient) Delete(path string, opts *client.DeleteOptions) error {
 	c.Unlock()
 	cntx, canceller := c.contextWithTimeout()
 	defer canceller()
-	_, err := c.kapi.Delete(cntx, path, opts)
-	if err != nil && !isErrNoNode(err) {
+	err := c.api.delete(cntx, path, recursive)
+	if err != nil {
 		xlog.Debug("etcd delete node %s failed: %s", path, err)
 		return err
 	}
@@ -160,6 +193,7 @@ func (c *EtcdClient) Delete(path string, opts *client.DeleteOptions) error {
 	return nil
 }
 
+// Read returns nil when the node doesn't exist or is a directory.
 func (c *EtcdClient) Read(path string) ([]byte, error) {
 	c.Lock()
 	//defer c.Unlock()
@@ -170,16 +204,10 @@ func (c *EtcdClient) Read(path string) ([]byte, error) {
 	cntx, canceller := c.contextWithTimeout()
 	defer canceller()
 	xlog.Debug("etcd read node %s", path)
-	r, err := c.kapi.Get(cntx, path, nil)
-	if err != nil && !isErrNoNode(err) {
-		return nil, err
-	} else if r == nil || r.Node.Dir {
-		return nil, nil
-	} else {
-		return []byte(r.Node.Value), nil
-	}
+	return c.api.read(cntx, path)
 }
 
+// List returns the keys of the direct children of path.
 func (c *EtcdClient) List(path string) ([]string, error) {
 	c.Lock()
 	//defer c.Unlock()
@@ -191,28 +219,42 @@ func (c *EtcdClient) List(path string) ([]string, error) {
 	cntx, canceller := c.contextWithTimeout()
 	defer canceller()
 	xlog.Debug("etcd list node %s", path)
-	r, err := c.kapi.Get(cntx, path, nil)
-	if err != nil && !isErrNoNode(err) {
-		return nil, err
-	} else if r == nil || !r.Node.Dir {
-		return nil, nil
-	} else {
-		var files []string
-		for _, node := range r.Node.Nodes {
-			files = append(files, node.Key)
-		}
-		return files, nil
+	return c.api.list(cntx, path)
+}
+
+// Index returns the current index of etcd, it isn't lower than the one of
+// the last change under path.
+func (c *EtcdClient) Index(path string) (uint64, error) {
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return 0, ErrClosedEtcdClient
 	}
+	c.Unlock()
+
+	cntx, canceller := c.contextWithTimeout()
+	defer canceller()
+	return c.api.index(cntx, path)
 }
 
-func (c *EtcdClient) Watch(path string, opts *client.WatcherOptions, respCh chan *client.Response, exitCh chan bool) {
+// Watch sends every change under path made from now on to evCh until
+// exitCh is closed.
+func (c *EtcdClient) Watch(path string, evCh chan *backend.Event, exitCh chan bool) {
+	c.WatchAfter(path, 0, evCh, exitCh)
+}
+
+// WatchAfter sends every change under path after index to evCh until
+// exitCh is closed, 0 starts at the current index. Errors never end the
+// watch: it reconnects with backoff and resumes after the last delivered
+// index, when that index was compacted a backend.ActionResync event is
+// sent and the watch goes on from the current index.
+func (c *EtcdClient) WatchAfter(path string, index uint64, evCh chan *backend.Event, exitCh chan bool) {
 	c.Lock()
 	if c.closed {
 		panic(ErrClosedEtcdClient)
 	}
 	c.Unlock()
 
-	watcher := c.kapi.Watcher(path, opts)
 	ctx, cancel := context.WithCancel(context.Background())
 	cancelRoutine := make(chan bool)
 	defer close(cancelRoutine)
@@ -226,14 +268,50 @@ func (c *EtcdClient) Watch(path string, opts *client.WatcherOptions, respCh chan
 		}
 	}()
 
+	var (
+		afterIndex = index
+		backoff    time.Duration
+		err        error
+	)
 	for {
-		res, err := watcher.Next(ctx)
-		if err != nil {
-			xlog.Fatal(err.Error())
+		if afterIndex == 0 {
+			// a watch lost before its first event resumes from here, not
+			// from the index of its reconnection
+			afterIndex, err = c.api.index(ctx, path)
+		}
+		if afterIndex > 0 {
+			var lastIndex uint64
+			lastIndex, err = c.api.watch(ctx, path, afterIndex, evCh)
+			if ctx.Err() != nil {
+				return
+			}
+			if lastIndex != afterIndex {
+				backoff = 0
+			}
+			afterIndex = lastIndex
+
+			if e, ok := err.(*indexClearedError); ok {
+				afterIndex = e.index
+				xlog.Warn("etcd watch %s: index cleared, resync from index %v", path, afterIndex)
+				ev := &backend.Event{Action: backend.ActionResync, Key: path, Dir: true, Index: afterIndex}
+				select {
+				case evCh <- ev:
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+		}
+		if ctx.Err() != nil {
 			return
 		}
-		if !c.closed {
-			respCh <- res
+
+		backoff = backend.NextBackoff(backoff)
+		xlog.Warn("etcd watch %s failed, retry after %v: %v", path, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
 		}
 	}
 }
@@ -1,6 +1,14 @@
 package etcd
 
 import (
+	"backend"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
@@ -8,7 +16,7 @@ import (
 )
 
 func newTestClient() *EtcdClient {
-	c, err := New("127.0.0.1:2379", time.Minute, "", "")
+	c, err := New(APIv2, "127.0.0.1:2379", time.Minute, "", "")
 	if err != nil {
 		panic(err)
 	}
@@ -20,6 +28,66 @@ func TestNewEtcdClient(t *testing.T) {
 	defer c.Close()
 }
 
+func Test_normalizeEndpoints(t *testing.T) {
+	endpoints, err := normalizeEndpoints("127.0.0.1:2379, https://10.0.0.1:2379", TLSConfig{})
+	tmp := []string{"http://127.0.0.1:2379", "https://10.0.0.1:2379"}
+	if err != nil || !reflect.DeepEqual(endpoints, tmp) {
+		t.Fatalf("test normalizeEndpoints failed, not expected data, %v<-->%v, err:%v", endpoints, tmp, err)
+	}
+
+	endpoints, err = normalizeEndpoints("127.0.0.1:2379", TLSConfig{RequireTLS: true})
+	tmp = []string{"https://127.0.0.1:2379"}
+	if err != nil || !reflect.DeepEqual(endpoints, tmp) {
+		t.Fatalf("test normalizeEndpoints failed, not expected data, %v<-->%v, err:%v", endpoints, tmp, err)
+	}
+
+	_, err = normalizeEndpoints("https://10.0.0.1:2379,http://127.0.0.1:2379", TLSConfig{RequireTLS: true})
+	if err == nil {
+		t.Fatal("test normalizeEndpoints failed, plaintext endpoint accepted")
+	}
+}
+
+func Test_tlsConfig(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "etcd-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	err = ioutil.WriteFile(caFile, ca, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := TLSConfig{}.config([]string{"http://127.0.0.1:2379"})
+	if err != nil || config != nil {
+		t.Fatalf("test tls config failed, plaintext expected, %v, err:%v", config, err)
+	}
+
+	config, err = TLSConfig{CAFile: caFile, ServerName: "example.com"}.config(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: newTransport(config)}).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	_, err = TLSConfig{CertFile: caFile}.config(nil)
+	if err == nil {
+		t.Fatal("test tls config failed, cert_file without key_file accepted")
+	}
+	_, err = TLSConfig{CAFile: filepath.Join(dir, "missing.pem")}.config(nil)
+	if err == nil {
+		t.Fatal("test tls config failed, missing ca_file accepted")
+	}
+}
+
 func Test_isErrNoNode(t *testing.T) {
 	err := client.Error{}
 	err.Code = client.ErrorCodeKeyNotFound
@@ -44,6 +112,18 @@ func Test_isErrNodeExists(t *testing.T) {
 	}
 }
 
+func Test_isErrIndexCleared(t *testing.T) {
+	err := client.Error{}
+	err.Code = client.ErrorCodeEventIndexCleared
+	if !isErrIndexCleared(err) {
+		t.Fatalf("test isErrIndexCleared failed, %v", err)
+	}
+	err.Code = client.ErrorCodeKeyNotFound
+	if isErrIndexCleared(err) {
+		t.Fatalf("test isErrIndexCleared failed, %v", err)
+	}
+}
+
 func TestMkdir(t *testing.T) {
 	c := newTestClient()
 	defer c.Close()
@@ -74,6 +154,34 @@ func TestCreate(t *testing.T) {
 	}
 }
 
+func TestCreateEphemeral(t *testing.T) {
+	c, err := New(APIv3, "127.0.0.1:2379", time.Minute, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/ker-unittest/ephemeral"
+	err = c.CreateEphemeral(path, []byte{})
+	if err != nil {
+		t.Fatalf("test CreateEphemeral failed, %v", err)
+	}
+	b, err := c.Read(path)
+	if err != nil || b == nil {
+		t.Fatalf("test CreateEphemeral failed, empty key missing, %v %v", b, err)
+	}
+
+	// the lease is revoked with the client
+	c.Close()
+	c, err = New(APIv3, "127.0.0.1:2379", time.Minute, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	b, err = c.Read(path)
+	if err != nil || b != nil {
+		t.Fatalf("test CreateEphemeral failed, key kept after close, %v %v", b, err)
+	}
+}
+
 func TestUpdate(t *testing.T) {
 	c := newTestClient()
 	defer c.Close()
@@ -116,7 +224,7 @@ func TestDelete(t *testing.T) {
 	c := newTestClient()
 	defer c.Close()
 	path := "/ker-unittest/dir/file"
-	err := c.Delete(path)
+	err := c.Delete(path, false)
 	if err != nil {
 		t.Fatalf("test delete failed, %v", err)
 	}
@@ -126,6 +234,8 @@ func TestWatch(t *testing.T) {
 	c := newTestClient()
 	defer c.Close()
 	path := "/ker-unittest/dir"
-	ch := make(chan string, 1)
-	go c.Watch(path, ch)
+	ch := make(chan *backend.Event, 1)
+	exitCh := make(chan bool)
+	defer close(exitCh)
+	go c.Watch(path, ch, exitCh)
 }
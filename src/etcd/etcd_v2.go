@@ -0,0 +1,185 @@
+package etcd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"time"
+
+	"backend"
+	"github.com/coreos/etcd/client"
+)
+
+var errEphemeralV2 = errors.New("etcd: ephemeral keys need api v3")
+
+type v2API struct {
+	kapi client.KeysAPI
+}
+
+func newV2(endpoints []string, tlsConfig *tls.Config, username, passwd string) (*v2API, error) {
+	transport := client.DefaultTransport
+	if tlsConfig != nil {
+		transport = newTransport(tlsConfig)
+	}
+	config := client.Config{
+		Endpoints:               endpoints,
+		Transport:               transport,
+		Username:                username,
+		Password:                passwd,
+		HeaderTimeoutPerRequest: time.Second * 3,
+	}
+	c, err := client.New(config)
+	if err != nil {
+		return nil, err
+	}
+	return &v2API{kapi: client.NewKeysAPI(c)}, nil
+}
+
+func isErrNoNode(err error) bool {
+	if err != nil {
+		if e, ok := err.(client.Error); ok {
+			return e.Code == client.ErrorCodeKeyNotFound
+		}
+	}
+	return false
+}
+
+func isErrNodeExists(err error) bool {
+	if err != nil {
+		if e, ok := err.(client.Error); ok {
+			return e.Code == client.ErrorCodeNodeExist
+		}
+	}
+	return false
+}
+
+func isErrIndexCleared(err error) bool {
+	if err != nil {
+		if e, ok := err.(client.Error); ok {
+			return e.Code == client.ErrorCodeEventIndexCleared
+		}
+	}
+	return false
+}
+
+// v2Action maps the v2 actions onto the backend actions.
+func v2Action(action string) string {
+	switch action {
+	case "compareAndSwap":
+		return backend.ActionSet
+	case "compareAndDelete", "expire":
+		return backend.ActionDelete
+	}
+	return action
+}
+
+func (a *v2API) mkdir(ctx context.Context, dir string) error {
+	_, err := a.kapi.Set(ctx, dir, "", &client.SetOptions{Dir: true, PrevExist: client.PrevNoExist})
+	if err != nil {
+		if isErrNodeExists(err) {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (a *v2API) create(ctx context.Context, path string, data []byte) error {
+	_, err := a.kapi.Set(ctx, path, string(data), &client.SetOptions{PrevExist: client.PrevNoExist})
+	if isErrNodeExists(err) {
+		return backend.ErrNodeExists
+	}
+	return err
+}
+
+// createEphemeral isn't supported, v2 has no leases.
+func (a *v2API) createEphemeral(ctx context.Context, path string, data []byte) error {
+	return errEphemeralV2
+}
+
+func (a *v2API) update(ctx context.Context, path string, data []byte) error {
+	_, err := a.kapi.Set(ctx, path, string(data), &client.SetOptions{PrevExist: client.PrevIgnore})
+	return err
+}
+
+func (a *v2API) delete(ctx context.Context, path string, recursive bool) error {
+	_, err := a.kapi.Delete(ctx, path, &client.DeleteOptions{Recursive: recursive})
+	if err != nil && !isErrNoNode(err) {
+		return err
+	}
+	return nil
+}
+
+func (a *v2API) read(ctx context.Context, path string) ([]byte, error) {
+	r, err := a.kapi.Get(ctx, path, nil)
+	if err != nil && !isErrNoNode(err) {
+		return nil, err
+	} else if r == nil || r.Node.Dir {
+		return nil, nil
+	} else {
+		return []byte(r.Node.Value), nil
+	}
+}
+
+func (a *v2API) list(ctx context.Context, path string) ([]string, error) {
+	r, err := a.kapi.Get(ctx, path, nil)
+	if err != nil && !isErrNoNode(err) {
+		return nil, err
+	} else if r == nil || !r.Node.Dir {
+		return nil, nil
+	} else {
+		var files []string
+		for _, node := range r.Node.Nodes {
+			files = append(files, node.Key)
+		}
+		return files, nil
+	}
+}
+
+func (a *v2API) index(ctx context.Context, path string) (uint64, error) {
+	r, err := a.kapi.Get(ctx, path, nil)
+	if err != nil {
+		if e, ok := err.(client.Error); ok && isErrNoNode(err) {
+			// etcd reports its current index along with the error
+			return e.Index, nil
+		}
+		return 0, err
+	}
+	return r.Index, nil
+}
+
+func (a *v2API) watch(ctx context.Context, path string, afterIndex uint64, evCh chan *backend.Event) (uint64, error) {
+	// the watcher starts from afterIndex+1
+	watcher := a.kapi.Watcher(path, &client.WatcherOptions{AfterIndex: afterIndex, Recursive: true})
+	for {
+		res, err := watcher.Next(ctx)
+		if err != nil {
+			if isErrIndexCleared(err) {
+				// etcd reports its current index along with the error
+				return afterIndex, &indexClearedError{index: err.(client.Error).Index}
+			}
+			return afterIndex, err
+		}
+		if res.Node == nil {
+			continue
+		}
+		afterIndex = res.Node.ModifiedIndex
+
+		ev := &backend.Event{
+			Action: v2Action(res.Action),
+			Key:    res.Node.Key,
+			Value:  res.Node.Value,
+			Dir:    res.Node.Dir,
+			Index:  res.Node.ModifiedIndex,
+		}
+		select {
+		case evCh <- ev:
+		case <-ctx.Done():
+			return afterIndex, ctx.Err()
+		}
+	}
+}
+
+func (a *v2API) close() error {
+	return nil
+}
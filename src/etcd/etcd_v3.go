@@ -0,0 +1,266 @@
+package etcd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"backend"
+	"github.com/coreos/etcd/clientv3"
+	"utils/xlog"
+)
+
+var errWatchClosed = errors.New("etcd watch channel closed")
+
+var (
+	// LeaseTTL is the ttl in seconds of the lease of the ephemeral keys
+	LeaseTTL int64 = 10
+)
+
+// v3API maps the directory layout of v2 onto the flat v3 keyspace,
+// a directory is the prefix "<dir>/" of its children. The ephemeral keys
+// share a lease, kept alive until close.
+type v3API struct {
+	cli     *clientv3.Client
+	timeout time.Duration
+
+	sync.Mutex
+	lease     clientv3.LeaseID
+	stopAlive context.CancelFunc
+}
+
+func newV3(endpoints []string, tlsConfig *tls.Config, timeout time.Duration, username, passwd string) (*v3API, error) {
+	config := clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: timeout,
+		TLS:         tlsConfig,
+		Username:    username,
+		Password:    passwd,
+	}
+	c, err := clientv3.New(config)
+	if err != nil {
+		return nil, err
+	}
+	return &v3API{cli: c, timeout: timeout}, nil
+}
+
+func dirPrefix(dir string) string {
+	return strings.TrimSuffix(dir, "/") + "/"
+}
+
+// childKeys returns the direct children of dir found in keys.
+func childKeys(dir string, keys []string) []string {
+	prefix := dirPrefix(dir)
+	var children []string
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		name := strings.SplitN(strings.TrimPrefix(key, prefix), "/", 2)[0]
+		if len(name) == 0 || seen[name] {
+			continue
+		}
+		seen[name] = true
+		children = append(children, prefix+name)
+	}
+	return children
+}
+
+// mkdir is a no-op, directories don't exist in v3.
+func (a *v3API) mkdir(ctx context.Context, dir string) error {
+	return nil
+}
+
+func (a *v3API) create(ctx context.Context, path string, data []byte) error {
+	resp, err := a.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(path), "=", 0)).
+		Then(clientv3.OpPut(path, string(data))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return backend.ErrNodeExists
+	}
+	return nil
+}
+
+func (a *v3API) createEphemeral(ctx context.Context, path string, data []byte) error {
+	lease, err := a.leaseID(ctx)
+	if err != nil {
+		return err
+	}
+	resp, err := a.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(path), "=", 0)).
+		Then(clientv3.OpPut(path, string(data), clientv3.WithLease(lease))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return backend.ErrNodeExists
+	}
+	return nil
+}
+
+// leaseID returns the lease of the ephemeral keys, it's granted on first
+// use and kept alive until close.
+func (a *v3API) leaseID(ctx context.Context) (clientv3.LeaseID, error) {
+	a.Lock()
+	defer a.Unlock()
+	if a.lease != clientv3.NoLease {
+		return a.lease, nil
+	}
+	grant, err := a.cli.Grant(ctx, LeaseTTL)
+	if err != nil {
+		return clientv3.NoLease, err
+	}
+	aliveCtx, stopAlive := context.WithCancel(context.Background())
+	aliveCh, err := a.cli.KeepAlive(aliveCtx, grant.ID)
+	if err != nil {
+		stopAlive()
+		a.cli.Revoke(ctx, grant.ID)
+		return clientv3.NoLease, err
+	}
+	a.lease, a.stopAlive = grant.ID, stopAlive
+	go a.keepAlive(grant.ID, aliveCh)
+	return grant.ID, nil
+}
+
+// keepAlive drains the responses of the keep-alive of lease. When they
+// end the lease is expired or revoked with its keys, the next ephemeral
+// key gets a new one.
+func (a *v3API) keepAlive(lease clientv3.LeaseID, aliveCh <-chan *clientv3.LeaseKeepAliveResponse) {
+	for range aliveCh {
+	}
+	a.Lock()
+	defer a.Unlock()
+	if a.lease == lease {
+		xlog.Warn("etcd lease %x of the ephemeral keys is lost", lease)
+		a.stopAlive()
+		a.lease, a.stopAlive = clientv3.NoLease, nil
+	}
+}
+
+func (a *v3API) update(ctx context.Context, path string, data []byte) error {
+	_, err := a.cli.Put(ctx, path, string(data))
+	return err
+}
+
+func (a *v3API) delete(ctx context.Context, path string, recursive bool) error {
+	_, err := a.cli.Delete(ctx, path)
+	if err != nil {
+		return err
+	}
+	if recursive {
+		_, err = a.cli.Delete(ctx, dirPrefix(path), clientv3.WithPrefix())
+	}
+	return err
+}
+
+func (a *v3API) read(ctx context.Context, path string) ([]byte, error) {
+	r, err := a.cli.Get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.Kvs) == 0 {
+		return nil, nil
+	}
+	return kvValue(r.Kvs[0].Value), nil
+}
+
+// kvValue returns the value of a key which exists, never nil: an empty
+// value comes as nil and would be taken for a missing key or a dir.
+func kvValue(value []byte) []byte {
+	if value == nil {
+		return []byte{}
+	}
+	return value
+}
+
+func (a *v3API) list(ctx context.Context, path string) ([]string, error) {
+	r, err := a.cli.Get(ctx, dirPrefix(path), clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(r.Kvs))
+	for _, kv := range r.Kvs {
+		keys = append(keys, string(kv.Key))
+	}
+	return childKeys(path, keys), nil
+}
+
+func (a *v3API) index(ctx context.Context, path string) (uint64, error) {
+	r, err := a.cli.Get(ctx, dirPrefix(path), clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return 0, err
+	}
+	return uint64(r.Header.Revision), nil
+}
+
+func (a *v3API) watch(ctx context.Context, path string, afterIndex uint64, evCh chan *backend.Event) (uint64, error) {
+	opts := []clientv3.OpOption{clientv3.WithPrefix()}
+	if afterIndex > 0 {
+		opts = append(opts, clientv3.WithRev(int64(afterIndex+1)))
+	}
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for wresp := range a.cli.Watch(wctx, dirPrefix(path), opts...) {
+		if wresp.CompactRevision != 0 {
+			return afterIndex, &indexClearedError{index: uint64(wresp.Header.Revision)}
+		}
+		if err := wresp.Err(); err != nil {
+			return afterIndex, err
+		}
+		for _, e := range wresp.Events {
+			ev := &backend.Event{
+				Key:   string(e.Kv.Key),
+				Value: string(e.Kv.Value),
+				Index: uint64(e.Kv.ModRevision),
+			}
+			switch {
+			case e.Type == clientv3.EventTypeDelete:
+				ev.Action = backend.ActionDelete
+			case e.IsCreate():
+				ev.Action = backend.ActionCreate
+			default:
+				ev.Action = backend.ActionSet
+			}
+			afterIndex = ev.Index
+
+			select {
+			case evCh <- ev:
+			case <-ctx.Done():
+				return afterIndex, ctx.Err()
+			}
+		}
+	}
+	return afterIndex, errWatchClosed
+}
+
+// close revokes the lease, the ephemeral keys go at once rather than at
+// the end of the ttl.
+func (a *v3API) close() error {
+	a.Lock()
+	lease, stopAlive := a.lease, a.stopAlive
+	a.lease, a.stopAlive = clientv3.NoLease, nil
+	a.Unlock()
+	if lease != clientv3.NoLease {
+		stopAlive()
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if a.timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, a.timeout)
+		}
+		_, err := a.cli.Revoke(ctx, lease)
+		cancel()
+		if err != nil {
+			xlog.Warn("etcd revoke lease %x is err, err:%v", lease, err)
+		}
+	}
+	return a.cli.Close()
+}
@@ -0,0 +1,48 @@
+package etcd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_childKeys(t *testing.T) {
+	keys := []string{
+		"/watcher/host/a.com/config",
+		"/watcher/host/a.com/config.d/ngx.conf",
+		"/watcher/host/b.com/config",
+		"/watcher/hostname/c.com/config",
+	}
+	children := childKeys("/watcher/host", keys)
+	tmp := []string{"/watcher/host/a.com", "/watcher/host/b.com"}
+	if !reflect.DeepEqual(children, tmp) {
+		t.Fatalf("test childKeys failed, not expected data, %v<-->%v", children, tmp)
+	}
+
+	children = childKeys("/watcher/host/a.com/", keys)
+	tmp = []string{"/watcher/host/a.com/config", "/watcher/host/a.com/config.d"}
+	if !reflect.DeepEqual(children, tmp) {
+		t.Fatalf("test childKeys failed, not expected data, %v<-->%v", children, tmp)
+	}
+}
+
+func Test_kvValue(t *testing.T) {
+	// an existing key with an empty value isn't missing
+	if v := kvValue(nil); v == nil || len(v) != 0 {
+		t.Fatalf("test kvValue failed, not expected data, %#v", v)
+	}
+	if v := kvValue([]byte("a")); string(v) != "a" {
+		t.Fatalf("test kvValue failed, not expected data, %s", v)
+	}
+}
+
+func Test_createEphemeralV2(t *testing.T) {
+	c, err := New(APIv2, "127.0.0.1:2379", time.Second, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.CreateEphemeral("/ker-unittest/ephemeral", nil); err != errEphemeralV2 {
+		t.Fatalf("test CreateEphemeral failed, v2 not refused, %v", err)
+	}
+}
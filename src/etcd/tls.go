@@ -0,0 +1,109 @@
+package etcd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TLSConfig secures the connection to etcd, the zero value connects in
+// plaintext like before.
+type TLSConfig struct {
+	CAFile     string // CA bundle of the servers, the system roots by default
+	CertFile   string // client certificate, with KeyFile
+	KeyFile    string
+	ServerName string // name checked in the server certificate, the host of the endpoint by default
+	// endpoints in plaintext are refused
+	RequireTLS bool
+}
+
+func (c TLSConfig) enabled() bool {
+	return len(c.CAFile) > 0 || len(c.CertFile) > 0 || len(c.KeyFile) > 0 ||
+		len(c.ServerName) > 0 || c.RequireTLS
+}
+
+// config returns the tls config of the client, nil for plaintext.
+func (c TLSConfig) config(endpoints []string) (*tls.Config, error) {
+	if !c.enabled() && !hasScheme(endpoints, "https://") {
+		return nil, nil
+	}
+	config := &tls.Config{
+		ServerName: c.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(c.CAFile) > 0 {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("etcd: no certificate found in %v", c.CAFile)
+		}
+	}
+	if len(c.CertFile) > 0 || len(c.KeyFile) > 0 {
+		if len(c.CertFile) == 0 || len(c.KeyFile) == 0 {
+			return nil, fmt.Errorf("etcd: cert_file and key_file must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func hasScheme(endpoints []string, scheme string) bool {
+	for _, s := range endpoints {
+		if strings.HasPrefix(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeEndpoints gives a scheme to the endpoints without one, https
+// when tls is enabled, and refuses the plaintext ones if tls is required.
+func normalizeEndpoints(addr string, c TLSConfig) ([]string, error) {
+	scheme := "http://"
+	if c.enabled() {
+		scheme = "https://"
+	}
+	var endpoints []string
+	for _, s := range strings.Split(addr, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.HasPrefix(s, "http://") && !strings.HasPrefix(s, "https://") {
+			s = scheme + s
+		}
+		if c.RequireTLS && !strings.HasPrefix(s, "https://") {
+			return nil, fmt.Errorf("etcd: endpoint %v isn't tls, require_tls is set", s)
+		}
+		endpoints = append(endpoints, s)
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("etcd: no endpoint")
+	}
+	return endpoints, nil
+}
+
+// newTransport is client.DefaultTransport with the tls config.
+func newTransport(config *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     config,
+	}
+}
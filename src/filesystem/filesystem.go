@@ -0,0 +1,265 @@
+package filesystem
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"backend"
+	"utils/xlog"
+)
+
+var ErrClosedFsClient = errors.New("use of closed filesystem client")
+
+// FsClient uses a local directory tree laid out like the keys as the
+// backend, the key "/watcher/web01/a.com/config" is the file
+// <root>/watcher/web01/a.com/config. Names starting with "." are ignored
+// so that editors and atomic writes can keep temporary files around.
+type FsClient struct {
+	sync.Mutex
+	root  string
+	index uint64 // of the last event of every watch, in unix nanoseconds
+
+	closed bool
+}
+
+func New(root string) (*FsClient, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &FsClient{root: root}, nil
+}
+
+func (c *FsClient) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *FsClient) isClosed() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.closed
+}
+
+// nextIndex returns the current time in nanoseconds, above every index
+// returned before, so that it compares with the mtimes of the files.
+func (c *FsClient) nextIndex() uint64 {
+	for {
+		last := atomic.LoadUint64(&c.index)
+		index := uint64(time.Now().UnixNano())
+		if index <= last {
+			index = last + 1
+		}
+		if atomic.CompareAndSwapUint64(&c.index, last, index) {
+			return index
+		}
+	}
+}
+
+// Index returns the current index, the changes made later have a higher
+// mtime.
+func (c *FsClient) Index(path string) (uint64, error) {
+	if c.isClosed() {
+		return 0, ErrClosedFsClient
+	}
+	return c.nextIndex(), nil
+}
+
+var errModified = errors.New("modified")
+
+// resyncAfter returns a backend.ActionResync event when a file or a
+// directory under dir was modified after index, nil otherwise.
+func (c *FsClient) resyncAfter(dir string, index uint64) *backend.Event {
+	if index == 0 {
+		return nil
+	}
+	err := filepath.Walk(dir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if file != dir && ignored(fi.Name()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if uint64(fi.ModTime().UnixNano()) > index {
+			return errModified
+		}
+		return nil
+	})
+	if err != errModified {
+		return nil
+	}
+	return &backend.Event{Action: backend.ActionResync, Key: c.key(dir), Dir: true, Index: c.nextIndex()}
+}
+
+// file returns the local path of a key.
+func (c *FsClient) file(path string) string {
+	return filepath.Join(c.root, filepath.FromSlash(filepath.Clean("/"+path)))
+}
+
+// key returns the key of a local path.
+func (c *FsClient) key(file string) string {
+	rel, err := filepath.Rel(c.root, file)
+	if err != nil || rel == "." {
+		return "/"
+	}
+	return "/" + filepath.ToSlash(rel)
+}
+
+func ignored(name string) bool {
+	return len(name) == 0 || strings.HasPrefix(name, ".")
+}
+
+// writeFile replaces the file through a rename, so that a watch sees the
+// whole content at once.
+func writeFile(file string, data []byte) error {
+	fd, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(data)
+	if err == nil {
+		err = fd.Chmod(0644)
+	}
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(fd.Name(), file)
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+	}
+	return err
+}
+
+func (c *FsClient) Mkdir(dir string) error {
+	if c.isClosed() {
+		return ErrClosedFsClient
+	}
+	return os.MkdirAll(c.file(dir), 0755)
+}
+
+func (c *FsClient) Create(path string, data []byte) error {
+	if c.isClosed() {
+		return ErrClosedFsClient
+	}
+	file := c.file(path)
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+	// not atomic, the local tree has a single writer in practice
+	_, err = os.Lstat(file)
+	if err == nil {
+		return backend.ErrNodeExists
+	}
+	err = writeFile(file, data)
+	if err != nil {
+		xlog.Debug("filesystem create node %s failed: %s", path, err)
+		return err
+	}
+	xlog.Debug("filesystem create node %s OK", path)
+	return nil
+}
+
+func (c *FsClient) Update(path string, data []byte) error {
+	if c.isClosed() {
+		return ErrClosedFsClient
+	}
+	file := c.file(path)
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err == nil {
+		err = writeFile(file, data)
+	}
+	if err != nil {
+		xlog.Debug("filesystem update node %s failed: %s", path, err)
+		return err
+	}
+	xlog.Debug("filesystem update node %s OK", path)
+	return nil
+}
+
+func (c *FsClient) Delete(path string, recursive bool) error {
+	if c.isClosed() {
+		return ErrClosedFsClient
+	}
+	var err error
+	if recursive {
+		err = os.RemoveAll(c.file(path))
+	} else {
+		err = os.Remove(c.file(path))
+	}
+	if err != nil && !os.IsNotExist(err) {
+		xlog.Debug("filesystem delete node %s failed: %s", path, err)
+		return err
+	}
+	xlog.Debug("filesystem delete node %s OK", path)
+	return nil
+}
+
+func (c *FsClient) Read(path string) ([]byte, error) {
+	if c.isClosed() {
+		return nil, ErrClosedFsClient
+	}
+	xlog.Debug("filesystem read node %s", path)
+	file := c.file(path)
+	fi, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if data == nil && err == nil {
+		data = []byte{}
+	}
+	return data, err
+}
+
+func (c *FsClient) List(path string) ([]string, error) {
+	if c.isClosed() {
+		return nil, ErrClosedFsClient
+	}
+	xlog.Debug("filesystem list node %s", path)
+	dir := c.file(path)
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		// not a directory
+		return nil, nil
+	}
+	var files []string
+	for _, fi := range infos {
+		if ignored(fi.Name()) {
+			continue
+		}
+		files = append(files, c.key(filepath.Join(dir, fi.Name())))
+	}
+	sort.Strings(files)
+	return files, nil
+}
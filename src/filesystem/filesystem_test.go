@@ -0,0 +1,152 @@
+package filesystem
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"backend"
+)
+
+func newTestClient(t *testing.T) (*FsClient, func()) {
+	root, err := ioutil.TempDir("", "watcher-fs-unittest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := New(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, func() {
+		c.Close()
+		os.RemoveAll(root)
+	}
+}
+
+func TestCreateReadList(t *testing.T) {
+	c, done := newTestClient(t)
+	defer done()
+
+	path := "/ker-unittest/dir/file"
+	err := c.Create(path, []byte("unittest1"))
+	if err != nil {
+		t.Fatalf("test Create failed, %v", err)
+	}
+	err = c.Create(path, []byte("unittest1"))
+	if err != backend.ErrNodeExists {
+		t.Fatalf("test Create failed, %v", err)
+	}
+	err = c.Update(path, []byte("unittest2"))
+	if err != nil {
+		t.Fatalf("test Update failed, %v", err)
+	}
+
+	b, err := c.Read(path)
+	if err != nil {
+		t.Fatalf("test read failed, %v", err)
+	}
+	if string(b) != "unittest2" {
+		t.Fatalf("test read failed, not expected data, %s<-->%s", string(b), "unittest2")
+	}
+	b, err = c.Read("/ker-unittest/dir")
+	if err != nil || b != nil {
+		t.Fatalf("test read failed, %v %v", b, err)
+	}
+
+	data, err := c.List("/ker-unittest/dir")
+	if err != nil {
+		t.Fatalf("test list failed, %v", err)
+	}
+	if len(data) != 1 || data[0] != path {
+		t.Fatalf("test list failed, not expected data, %v", data)
+	}
+
+	err = c.Delete("/ker-unittest", true)
+	if err != nil {
+		t.Fatalf("test delete failed, %v", err)
+	}
+	b, err = c.Read(path)
+	if err != nil || b != nil {
+		t.Fatalf("test delete failed, %v %v", b, err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	c, done := newTestClient(t)
+	defer done()
+
+	path := "/ker-unittest/dir"
+	ch := make(chan *backend.Event, 10)
+	exitCh := make(chan bool)
+	defer close(exitCh)
+	go c.Watch(path, ch, exitCh)
+	time.Sleep(100 * time.Millisecond)
+
+	steps := []struct {
+		op     func()
+		action string
+		key    string
+		value  string
+	}{
+		{func() { c.Update(path+"/file", []byte("unittest1")) }, backend.ActionCreate, path + "/file", "unittest1"},
+		{func() { c.Update(path+"/file", []byte("unittest2")) }, backend.ActionSet, path + "/file", "unittest2"},
+		{func() { c.Delete(path+"/file", false) }, backend.ActionDelete, path + "/file", ""},
+		{func() { c.Mkdir(path + "/sub") }, backend.ActionCreate, path + "/sub", ""},
+		{func() { c.Update(path+"/sub/file", []byte("unittest3")) }, backend.ActionCreate, path + "/sub/file", "unittest3"},
+	}
+	var index uint64
+	for _, step := range steps {
+		step.op()
+		select {
+		case ev := <-ch:
+			if ev.Action != step.action || ev.Key != step.key || ev.Value != step.value {
+				t.Fatalf("test watch failed, not expected event, %+v", ev)
+			}
+			if ev.Index <= index {
+				t.Fatalf("test watch failed, index doesn't increase, %v<-->%v", ev.Index, index)
+			}
+			index = ev.Index
+		case <-time.After(5 * time.Second):
+			t.Fatalf("test watch failed, no event for %v", step.key)
+		}
+	}
+}
+
+func TestWatchAfter(t *testing.T) {
+	c, done := newTestClient(t)
+	defer done()
+
+	path := "/ker-unittest/after"
+	c.Update(path+"/file", []byte("unittest1"))
+	index, err := c.Index(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unchanged since the index, nothing to resync
+	ch := make(chan *backend.Event, 10)
+	exitCh := make(chan bool)
+	go c.WatchAfter(path, index, ch, exitCh)
+	select {
+	case ev := <-ch:
+		t.Fatalf("test watch after failed, not expected event, %+v", ev)
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(exitCh)
+
+	// deleted before the watch started
+	c.Delete(path+"/file", false)
+	ch = make(chan *backend.Event, 10)
+	exitCh = make(chan bool)
+	defer close(exitCh)
+	go c.WatchAfter(path, index, ch, exitCh)
+	select {
+	case ev := <-ch:
+		if ev.Action != backend.ActionResync || ev.Key != path || ev.Index <= index {
+			t.Fatalf("test watch after failed, not expected event, %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("test watch after failed, no resync")
+	}
+}
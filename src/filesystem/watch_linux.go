@@ -0,0 +1,279 @@
+//go:build linux
+// +build linux
+
+package filesystem
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"backend"
+	"utils/xlog"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO |
+	syscall.IN_MOVED_FROM | syscall.IN_DELETE
+
+var errQueueOverflow = fmt.Errorf("inotify queue overflow")
+
+// inotify follows a directory tree, a watch is added for every directory.
+type inotify struct {
+	c      *FsClient
+	fd     int
+	dirs   map[int32]string
+	known  map[string]bool // files already reported
+	evCh   chan *backend.Event
+	exitCh chan bool
+}
+
+// Watch uses inotify to send every change under path to evCh until exitCh
+// is closed, the directory of path is created when it is missing.
+func (c *FsClient) Watch(path string, evCh chan *backend.Event, exitCh chan bool) {
+	c.WatchAfter(path, 0, evCh, exitCh)
+}
+
+// WatchAfter is Watch sending a backend.ActionResync event first when the
+// tree was modified after index, the changes aren't replayed. The changes
+// made while the watch is broken are found the same way.
+func (c *FsClient) WatchAfter(path string, index uint64, evCh chan *backend.Event, exitCh chan bool) {
+	var backoff time.Duration
+	for {
+		err := c.watch(path, index, evCh, exitCh)
+		if err == nil || c.isClosed() {
+			return
+		}
+		index = c.nextIndex()
+		if err == errQueueOverflow {
+			// events were dropped by the kernel
+			ev := &backend.Event{Action: backend.ActionResync, Key: c.key(c.file(path)), Dir: true, Index: c.nextIndex()}
+			select {
+			case evCh <- ev:
+			case <-exitCh:
+				return
+			}
+			continue
+		}
+
+		backoff = backend.NextBackoff(backoff)
+		xlog.Warn("filesystem watch %s failed, retry after %v: %v", path, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-exitCh:
+			return
+		}
+	}
+}
+
+// watch returns nil when exitCh is closed.
+func (c *FsClient) watch(path string, index uint64, evCh chan *backend.Event, exitCh chan bool) error {
+	dir := c.file(path)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		// nothing under it was read
+		index = 0
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	// a non-blocking fd is served by the runtime poller, closing the
+	// file wakes up the pending Read
+	f := os.NewFile(uintptr(fd), "inotify")
+	defer f.Close()
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-exitCh:
+			f.Close()
+		case <-done:
+		}
+	}()
+
+	in := &inotify{
+		c:      c,
+		fd:     fd,
+		dirs:   make(map[int32]string),
+		known:  make(map[string]bool),
+		evCh:   evCh,
+		exitCh: exitCh,
+	}
+	_, err = in.addTree(dir, false)
+	if err != nil {
+		return err
+	}
+	if ev := c.resyncAfter(dir, index); ev != nil && !in.sendEvent(ev) {
+		return nil
+	}
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			select {
+			case <-exitCh:
+				return nil
+			default:
+				return err
+			}
+		}
+
+		offset := 0
+		for offset+syscall.SizeofInotifyEvent <= n {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			offset = start + int(raw.Len)
+			name := string(bytes.TrimRight(buf[start:offset], "\x00"))
+
+			if raw.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				return errQueueOverflow
+			}
+			if !in.handle(raw.Wd, raw.Mask, name) {
+				return nil
+			}
+		}
+	}
+}
+
+// addTree watches dir and the directories below it, with send set a
+// create event is sent for everything found.
+func (in *inotify) addTree(dir string, send bool) (bool, error) {
+	wd, err := syscall.InotifyAddWatch(in.fd, dir, watchMask)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return true, err
+	}
+	in.dirs[int32(wd)] = dir
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return true, nil
+	}
+	for _, fi := range infos {
+		if ignored(fi.Name()) {
+			continue
+		}
+		file := filepath.Join(dir, fi.Name())
+		if fi.IsDir() {
+			if send && !in.send(backend.ActionCreate, file, true) {
+				return false, nil
+			}
+			ok, err := in.addTree(file, send)
+			if !ok || err != nil {
+				return ok, err
+			}
+			continue
+		}
+		if send {
+			if !in.sendFile(file) {
+				return false, nil
+			}
+		} else {
+			in.known[file] = true
+		}
+	}
+	return true, nil
+}
+
+// handle returns false when exitCh is closed.
+func (in *inotify) handle(wd int32, mask uint32, name string) bool {
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(in.dirs, wd)
+		return true
+	}
+	dir, ok := in.dirs[wd]
+	if !ok || ignored(name) {
+		return true
+	}
+	file := filepath.Join(dir, name)
+	isDir := mask&syscall.IN_ISDIR != 0
+
+	switch {
+	case isDir && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+		if !in.send(backend.ActionCreate, file, true) {
+			return false
+		}
+		ok, err := in.addTree(file, true)
+		if err != nil {
+			xlog.Warn("filesystem watch %s failed: %v", file, err)
+		}
+		return ok
+	case !isDir && mask&(syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO) != 0:
+		return in.sendFile(file)
+	case mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+		if isDir {
+			in.forget(file)
+		}
+		delete(in.known, file)
+		return in.send(backend.ActionDelete, file, isDir)
+	}
+	return true
+}
+
+// forget removes the watches and files below a directory moved away.
+func (in *inotify) forget(dir string) {
+	prefix := dir + string(filepath.Separator)
+	for wd, d := range in.dirs {
+		if d == dir || strings.HasPrefix(d, prefix) {
+			syscall.InotifyRmWatch(in.fd, uint32(wd))
+			delete(in.dirs, wd)
+		}
+	}
+	for file := range in.known {
+		if strings.HasPrefix(file, prefix) {
+			delete(in.known, file)
+		}
+	}
+}
+
+func (in *inotify) sendFile(file string) bool {
+	action := backend.ActionSet
+	if !in.known[file] {
+		action = backend.ActionCreate
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		// removed in the meantime, the delete event follows
+		return true
+	}
+	in.known[file] = true
+	ev := &backend.Event{
+		Action: action,
+		Key:    in.c.key(file),
+		Value:  string(data),
+		Index:  in.c.nextIndex(),
+	}
+	return in.sendEvent(ev)
+}
+
+func (in *inotify) send(action, file string, dir bool) bool {
+	ev := &backend.Event{
+		Action: action,
+		Key:    in.c.key(file),
+		Dir:    dir,
+		Index:  in.c.nextIndex(),
+	}
+	return in.sendEvent(ev)
+}
+
+func (in *inotify) sendEvent(ev *backend.Event) bool {
+	select {
+	case in.evCh <- ev:
+		return true
+	case <-in.exitCh:
+		return false
+	}
+}
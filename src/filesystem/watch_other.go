@@ -0,0 +1,122 @@
+//go:build !linux
+// +build !linux
+
+package filesystem
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"backend"
+)
+
+var (
+	// PollInterval is how often the tree is scanned without inotify
+	PollInterval = 1 * time.Second
+)
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+	dir     bool
+}
+
+func (c *FsClient) scan(dir string, states map[string]fileState) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range infos {
+		if ignored(fi.Name()) {
+			continue
+		}
+		file := filepath.Join(dir, fi.Name())
+		states[file] = fileState{modTime: fi.ModTime(), size: fi.Size(), dir: fi.IsDir()}
+		if fi.IsDir() {
+			c.scan(file, states)
+		}
+	}
+}
+
+// Watch scans the tree under path every PollInterval and sends the
+// difference with the previous scan as events until exitCh is closed.
+func (c *FsClient) Watch(path string, evCh chan *backend.Event, exitCh chan bool) {
+	c.WatchAfter(path, 0, evCh, exitCh)
+}
+
+// WatchAfter is Watch sending a backend.ActionResync event first when the
+// tree was modified after index, the changes aren't replayed.
+func (c *FsClient) WatchAfter(path string, index uint64, evCh chan *backend.Event, exitCh chan bool) {
+	dir := c.file(path)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		// nothing under it was read
+		index = 0
+	}
+	os.MkdirAll(dir, 0755)
+	states := make(map[string]fileState)
+	c.scan(dir, states)
+	if ev := c.resyncAfter(dir, index); ev != nil {
+		select {
+		case evCh <- ev:
+		case <-exitCh:
+			return
+		}
+	}
+
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-exitCh:
+			return
+		}
+		if c.isClosed() {
+			return
+		}
+
+		newStates := make(map[string]fileState)
+		c.scan(dir, newStates)
+		var evs []*backend.Event
+		for file, st := range newStates {
+			old, ok := states[file]
+			ev := &backend.Event{Key: c.key(file), Dir: st.dir}
+			if !ok {
+				ev.Action = backend.ActionCreate
+			} else if !st.dir && (old.modTime != st.modTime || old.size != st.size) {
+				ev.Action = backend.ActionSet
+			} else {
+				continue
+			}
+			if !st.dir {
+				data, err := ioutil.ReadFile(file)
+				if err != nil {
+					delete(newStates, file)
+					continue
+				}
+				ev.Value = string(data)
+			}
+			evs = append(evs, ev)
+		}
+		for file, st := range states {
+			if _, ok := newStates[file]; !ok {
+				evs = append(evs, &backend.Event{Action: backend.ActionDelete, Key: c.key(file), Dir: st.dir})
+			}
+		}
+		states = newStates
+
+		// parents sort before their children
+		sort.Slice(evs, func(i, j int) bool { return evs[i].Key < evs[j].Key })
+		for _, ev := range evs {
+			ev.Index = c.nextIndex()
+			select {
+			case evCh <- ev:
+			case <-exitCh:
+				return
+			}
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"strings"
 	"time"
+	"utils"
 )
 
 var (
@@ -13,9 +14,11 @@ var (
 )
 
 type Heartbeat struct {
-	Version   string `json:"version"`
-	Hostname  string `json:"hostname"`
-	Timestamp int64  `json:"timestamp"`
+	Version    string `json:"version"`
+	Hostname   string `json:"hostname"`
+	Timestamp  int64  `json:"timestamp"`
+	QueueDepth int    `json:"queueDepth"` // events waiting to be deployed
+	OutboxSize int    `json:"outboxSize"` // callbacks not delivered yet
 	//Ip        string `json:"ip"`
 	//LiveTime  string `json:"livetime"`
 }
@@ -38,6 +41,11 @@ func Decode(context string) (*Heartbeat, error) {
 }
 
 func (h *Heartbeat) Callback(url string) (err error) {
+	return h.SignedCallback(url, "")
+}
+
+// SignedCallback signs the heartbeat with secret, see utils.SignRequest.
+func (h *Heartbeat) SignedCallback(url, secret string) (err error) {
 	if len(url) == 0 {
 		err = fmt.Errorf("Heartbeat: url is null")
 		return
@@ -54,11 +62,17 @@ func (h *Heartbeat) Callback(url string) (err error) {
 	}
 
 	client := http.Client{Timeout: respTimeout}
-	body := strings.NewReader(string(jsonByte))
-	resp, err := client.Post(url, "application/json", body)
+	req, err := http.NewRequest("POST", url, strings.NewReader(string(jsonByte)))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	utils.SignRequest(req, secret, jsonByte)
+	resp, err := client.Do(req)
 	if err != nil {
 		return
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		err = fmt.Errorf("Heartbeat: post to %v is err, err: %v", url, resp.Status)
 		return
@@ -66,3 +80,13 @@ func (h *Heartbeat) Callback(url string) (err error) {
 
 	return
 }
+
+// Verify checks the signature of a heartbeat received from watcher and
+// decodes it, for the receivers written in go.
+func Verify(r *http.Request, secret string) (*Heartbeat, error) {
+	body, err := utils.VerifyRequest(r, secret)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(string(body))
+}
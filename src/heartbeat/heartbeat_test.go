@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 )
@@ -25,6 +26,32 @@ func TestHeartbeat(t *testing.T) {
 	}
 }
 
+func TestSignedHeartbeat(t *testing.T) {
+	hCh := make(chan *Heartbeat, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, err := Verify(r, "secret")
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		hCh <- h
+	}))
+	defer ts.Close()
+
+	h := &Heartbeat{Version: Version, Hostname: "localhost", Timestamp: time.Now().Unix()}
+	err := h.SignedCallback(ts.URL, "other")
+	if err == nil {
+		t.Fatal("test signed heartbeat failed, wrong secret accepted")
+	}
+	err = h.SignedCallback(ts.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret := <-hCh; *ret != *h {
+		t.Fatalf("test signed heartbeat failed, %+v<-->%+v", ret, h)
+	}
+}
+
 func handleHearbeat(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -1,25 +1,123 @@
 package utils
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"os"
 	"os/exec"
+	"syscall"
 	"time"
 )
 
+var (
+	// bytes kept of stdout and of stderr by default
+	DefaultMaxOutput = 64 * 1024
+)
+
+// CmdOptions are the options of CommandWithOptions.
+type CmdOptions struct {
+	Timeout   time.Duration
+	Env       []string // "KEY=value" added to the environment of watcher
+	Dir       string   // working directory
+	User      string   // run as this user name or uid
+	Group     string   // and group, the primary group of User by default
+	MaxOutput int      // bytes kept of stdout and of stderr
+}
+
+// CmdResult tells how the command ended.
+type CmdResult struct {
+	Success   bool
+	Stdout    []byte
+	Stderr    []byte
+	Truncated bool   // stdout or stderr was longer than MaxOutput
+	TimedOut  bool   // killed when the timeout expired
+	ExitCode  int    // -1 when the command didn't exit by itself
+	Signal    string // the signal which ended the command
+	StartedAt time.Time
+	Duration  time.Duration
+}
+
+// cappedBuffer keeps the first max bytes written to it.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	left := b.max - b.buf.Len()
+	if len(p) > left {
+		b.truncated = true
+		if left > 0 {
+			b.buf.Write(p[:left])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
 func Command(timeout time.Duration, name string, arg ...string) (cmdSuccess bool, cmdOut []byte, err error) {
+	res, err := CommandWithOptions(CmdOptions{Timeout: timeout}, name, arg...)
+	return res.Success, res.Stdout, err
+}
+
+func CommandWithOptions(opt CmdOptions, name string, arg ...string) (res CmdResult, err error) {
+	res.ExitCode = -1
+	timeout := opt.Timeout
 	if timeout <= 0 {
-		timeout = 5
+		timeout = 5 * time.Second
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, name, arg...)
-	cmdOut, err = cmd.Output()
+	if len(opt.Env) > 0 {
+		cmd.Env = append(os.Environ(), opt.Env...)
+	}
+	cmd.Dir = opt.Dir
+	if len(opt.User) > 0 || len(opt.Group) > 0 {
+		cmd.SysProcAttr, err = runAs(opt.User, opt.Group)
+		if err != nil {
+			return
+		}
+	}
+	killGroup(cmd)
+	// don't wait for the children still holding the output
+	cmd.WaitDelay = time.Second
+
+	maxOutput := opt.MaxOutput
+	if maxOutput <= 0 {
+		maxOutput = DefaultMaxOutput
+	}
+	stdout := &cappedBuffer{max: maxOutput}
+	stderr := &cappedBuffer{max: maxOutput}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	res.StartedAt = time.Now()
+	err = cmd.Run()
+	res.Duration = time.Since(res.StartedAt)
+	res.Stdout = stdout.buf.Bytes()
+	res.Stderr = stderr.buf.Bytes()
+	res.Truncated = stdout.truncated || stderr.truncated
+	res.TimedOut = ctx.Err() == context.DeadlineExceeded
+	if cmd.ProcessState != nil {
+		res.ExitCode = cmd.ProcessState.ExitCode()
+		if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			res.Signal = ws.Signal().String()
+		}
+	}
+	// a background child kept the output open, the command itself is done
+	if errors.Is(err, exec.ErrWaitDelay) && !res.TimedOut && cmd.ProcessState.Success() {
+		err = nil
+		res.Truncated = true
+	}
 	if err != nil {
 		return
 	}
-	cmdSuccess = cmd.ProcessState.Success()
+	res.Success = cmd.ProcessState.Success()
 
 	return
 }
@@ -1,6 +1,10 @@
 package utils
 
 import (
+	"os"
+	"os/user"
+	"runtime"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -35,3 +39,83 @@ func TestCommandWithTimeout(t *testing.T) {
 	}
 
 }
+
+func TestCommandWithEnv(t *testing.T) {
+	opt := CmdOptions{Timeout: 5 * time.Second, Env: []string{"WATCHER_UNITTEST=a b"}}
+	res, err := CommandWithOptions(opt, "/bin/sh", "-c", `echo "$WATCHER_UNITTEST"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Success || string(res.Stdout) != "a b\n" {
+		t.Fatalf("test command with env failed, not expected output, %q", res.Stdout)
+	}
+}
+
+func TestCommandResult(t *testing.T) {
+	res, err := CommandWithOptions(CmdOptions{Timeout: time.Second, Dir: "/"}, "/bin/sh", "-c", "pwd; exit 3")
+	if err == nil || res.Success || res.ExitCode != 3 || res.TimedOut || string(res.Stdout) != "/\n" {
+		t.Fatalf("test command result failed, %+v %v", res, err)
+	}
+
+	res, err = CommandWithOptions(CmdOptions{Timeout: 100 * time.Millisecond}, "sleep", "2")
+	if err == nil || !res.TimedOut || res.Signal != "killed" {
+		t.Fatalf("test command timeout failed, %+v %v", res, err)
+	}
+
+	_, err = CommandWithOptions(CmdOptions{User: "watcher-no-such-user"}, "true")
+	if err == nil {
+		t.Fatal("test command run as failed, unknown user is accepted")
+	}
+}
+
+func TestCommandBackgroundChild(t *testing.T) {
+	res, err := CommandWithOptions(CmdOptions{Timeout: 5 * time.Second}, "/bin/sh", "-c", "sleep 5 & echo started")
+	if err != nil || !res.Success || res.ExitCode != 0 || !res.Truncated || string(res.Stdout) != "started\n" {
+		t.Fatalf("test command with a background child failed, %+v %v", res, err)
+	}
+	if res.Duration >= 5*time.Second {
+		t.Fatalf("test command with a background child failed, waited for the child, %v", res.Duration)
+	}
+}
+
+func TestCommandMaxOutput(t *testing.T) {
+	res, err := CommandWithOptions(CmdOptions{MaxOutput: 4}, "/bin/sh", "-c", "echo 123456789")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res.Stdout) != "1234" || !res.Truncated || res.Duration <= 0 {
+		t.Fatalf("test command max output failed, %+v", res)
+	}
+}
+
+func TestCommandRunAsGroups(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() != 0 {
+		t.Skip("changing user needs root")
+	}
+	u, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no user nobody")
+	}
+	expected, err := u.GroupIds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected, u.Gid)
+
+	// the groups of watcher aren't kept
+	res, err := CommandWithOptions(CmdOptions{User: "nobody"}, "id", "-G")
+	if err != nil || !res.Success {
+		t.Fatalf("id -G as nobody failed, err:%v, stderr:%s", err, res.Stderr)
+	}
+	groups := strings.Fields(string(res.Stdout))
+	for _, g := range groups {
+		found := false
+		for _, e := range expected {
+			found = found || g == e
+		}
+		if !found {
+			sort.Strings(groups)
+			t.Fatalf("group %v kept, groups:%v, want within %v", g, groups, expected)
+		}
+	}
+}
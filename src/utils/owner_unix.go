@@ -0,0 +1,49 @@
+//go:build !windows
+// +build !windows
+
+package utils
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+func fileOwner(fi os.FileInfo) (uid, gid int) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int(st.Uid), int(st.Gid)
+	}
+	return -1, -1
+}
+
+// LookupOwner returns the ids of the user and the group, given by name or
+// by id, -1 for the empty ones.
+func LookupOwner(name, group string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if len(name) > 0 {
+		uid, err = strconv.Atoi(name)
+		if err != nil {
+			var u *user.User
+			u, err = lookupUser(name)
+			if err != nil {
+				return
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+	if len(group) > 0 {
+		gid, err = strconv.Atoi(group)
+		if err != nil {
+			var g *user.Group
+			g, err = user.LookupGroup(group)
+			if err != nil {
+				err = fmt.Errorf("unknown group %v", group)
+				return
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return
+}
@@ -0,0 +1,18 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+)
+
+// files have no uid/gid on windows
+func fileOwner(fi os.FileInfo) (uid, gid int) {
+	return -1, -1
+}
+
+func LookupOwner(name, group string) (uid, gid int, err error) {
+	if len(name) > 0 || len(group) > 0 {
+		err = fmt.Errorf("file owner %v:%v is not supported on windows", name, group)
+	}
+	return -1, -1, err
+}
@@ -0,0 +1,80 @@
+//go:build !windows
+// +build !windows
+
+package utils
+
+import (
+	"fmt"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// runAs returns the attributes running a command as the user and group.
+// The supplementary groups are the ones of the user, the command doesn't
+// keep the ones of watcher.
+func runAs(name, group string) (*syscall.SysProcAttr, error) {
+	uid, gid := syscall.Getuid(), syscall.Getgid()
+	var groupIds []string
+	if len(name) > 0 {
+		u, err := lookupUser(name)
+		if err != nil {
+			return nil, err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+		groupIds, err = u.GroupIds()
+		if err != nil {
+			return nil, fmt.Errorf("groups of user %v, %v", name, err)
+		}
+	}
+	if len(group) > 0 {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			g, err = user.LookupGroupId(group)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unknown group %v", group)
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	cred := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	if syscall.Geteuid() != 0 {
+		// only root may set the groups, and has any to drop
+		cred.NoSetGroups = true
+		return &syscall.SysProcAttr{Credential: cred}, nil
+	}
+	cred.Groups = []uint32{uint32(gid)}
+	for _, id := range groupIds {
+		n, err := strconv.ParseUint(id, 10, 32)
+		if err == nil && uint32(n) != uint32(gid) {
+			cred.Groups = append(cred.Groups, uint32(n))
+		}
+	}
+	return &syscall.SysProcAttr{Credential: cred}, nil
+}
+
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		u, err = user.LookupId(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unknown user %v", name)
+	}
+	return u, nil
+}
+
+// killGroup makes the timeout kill the children of the command as well,
+// like the ones of "/bin/sh -c".
+func killGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
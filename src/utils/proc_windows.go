@@ -0,0 +1,15 @@
+package utils
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// commands can't change user on windows
+func runAs(name, group string) (*syscall.SysProcAttr, error) {
+	return nil, fmt.Errorf("run as user %v is not supported on windows", name)
+}
+
+func killGroup(cmd *exec.Cmd) {
+}
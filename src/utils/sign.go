@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	TimestampHeader = "X-Watcher-Timestamp"
+	SignatureHeader = "X-Watcher-Signature"
+)
+
+var (
+	ErrNoSignature  = errors.New("request isn't signed")
+	ErrBadSignature = errors.New("signature doesn't match")
+	ErrBadTimestamp = errors.New("timestamp is too old or invalid")
+
+	// requests signed longer ago are refused, against replays
+	MaxSignatureAge = 5 * time.Minute
+)
+
+/*
+HMAC-SHA256签名：对"时间戳.body"用secret签名，返回16进制字符串
+*/
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+为请求加上时间戳和签名头，secret为空时不签名
+*/
+func SignRequest(req *http.Request, secret string, body []byte) {
+	if len(secret) == 0 {
+		return
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(secret, timestamp, body))
+}
+
+/*
+校验请求的签名，时间戳与当前时间相差超过MaxSignatureAge时拒绝。返回请求的body
+*/
+func VerifyRequest(r *http.Request, secret string) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	signature := r.Header.Get(SignatureHeader)
+	if len(signature) == 0 {
+		return nil, ErrNoSignature
+	}
+	timestamp, err := strconv.ParseInt(r.Header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return nil, ErrBadTimestamp
+	}
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > MaxSignatureAge || age < -MaxSignatureAge {
+		return nil, ErrBadTimestamp
+	}
+	expected := Sign(secret, timestamp, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return nil, ErrBadSignature
+	}
+	return body, nil
+}
@@ -7,11 +7,14 @@ import (
 	"errors"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"unsafe"
 )
 
 var (
 	ErrEmptyArguments = errors.New("Argument Cann't be empty")
+
+	DefaultFileMode os.FileMode = 0644
 )
 
 /*
@@ -27,23 +30,116 @@ func FileExists(filename string) bool {
 	return true
 }
 
+// FileOptions of FileWriteWithOptions, the zero values keep the mode and
+// the owner of the existing file.
+type FileOptions struct {
+	Mode  os.FileMode // permission bits
+	User  string      // name or id
+	Group string      // name or id
+}
+
+/*
+原子写文件：先写入同目录下的临时文件并fsync，再rename覆盖目标文件，
+读取方不会看到写了一半的文件。目标文件存在时保留其权限和属主，否则使用DefaultFileMode
+*/
 func FileWrite(filename string, content *string) (err error) {
-	fd, err := os.OpenFile(filename, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0666)
+	return FileWriteWithOptions(filename, content, FileOptions{})
+}
+
+/*
+与FileWrite相同，但使用opt中指定的权限和属主，在rename之前设置到临时文件上，
+目标文件不会以错误的权限出现。指定的属主无法设置时返回错误
+*/
+func FileWriteWithOptions(filename string, content *string, opt FileOptions) (err error) {
+	mode := DefaultFileMode
+	uid, gid := -1, -1
+	if fi, statErr := os.Stat(filename); statErr == nil {
+		mode = fi.Mode().Perm()
+		uid, gid = fileOwner(fi)
+	}
+	if opt.Mode != 0 {
+		mode = opt.Mode.Perm()
+	}
+	chown := len(opt.User) > 0 || len(opt.Group) > 0
+	if chown {
+		var ouid, ogid int
+		ouid, ogid, err = LookupOwner(opt.User, opt.Group)
+		if err != nil {
+			return
+		}
+		if ouid >= 0 {
+			uid = ouid
+		}
+		if ogid >= 0 {
+			gid = ogid
+		}
+	}
+
+	dir, base := filepath.Split(filename)
+	if len(dir) == 0 {
+		dir = "."
+	}
+	fd, err := ioutil.TempFile(dir, "."+base+".watcher")
 	if err != nil {
 		return
 	}
-	defer fd.Close()
-	bw := bufio.NewWriter(fd)
+	tmpname := fd.Name()
+	defer func() {
+		if err != nil {
+			fd.Close()
+			os.Remove(tmpname)
+		}
+	}()
 
+	bw := bufio.NewWriter(fd)
 	_, err = bw.WriteString(*content)
 	if err != nil {
 		return
 	}
-	bw.Flush()
+	err = bw.Flush()
+	if err != nil {
+		return
+	}
+	err = fd.Chmod(mode)
+	if err != nil {
+		return
+	}
+	if uid >= 0 || gid >= 0 {
+		// only root may give the file away, keep going otherwise unless
+		// the owner was asked for
+		if chownErr := fd.Chown(uid, gid); chownErr != nil && (chown || !os.IsPermission(chownErr)) {
+			err = chownErr
+			return
+		}
+	}
+	err = fd.Sync()
+	if err != nil {
+		return
+	}
+	err = fd.Close()
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmpname, filename)
+	if err != nil {
+		return
+	}
 
+	// persist the rename
+	if d, dirErr := os.Open(dir); dirErr == nil {
+		d.Sync()
+		d.Close()
+	}
 	return
 }
 
+/*
+返回文件的uid和gid，不支持时为-1
+*/
+func FileOwner(fi os.FileInfo) (uid, gid int) {
+	return fileOwner(fi)
+}
+
 /*
 判断给定的filename是否是一个目录
 */
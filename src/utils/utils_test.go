@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFileWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "utils-unittest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "a.conf")
+	content := "aaaaaaaa"
+	err = FileWrite(filename, &content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret, err := LoadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret != content {
+		t.Fatalf("ret != content, %v<-->%v", ret, content)
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != DefaultFileMode {
+		t.Fatalf("file mode is %v, want %v", fi.Mode().Perm(), DefaultFileMode)
+	}
+
+	// the mode of an existing file is kept
+	err = os.Chmod(filename, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content = "bbbbbbbbb"
+	err = FileWrite(filename, &content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret, err = LoadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret != content {
+		t.Fatalf("ret != content, %v<-->%v", ret, content)
+	}
+	fi, err = os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("file mode is %v, want %v", fi.Mode().Perm(), os.FileMode(0600))
+	}
+
+	// no temporary file is left behind
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 {
+		t.Fatalf("there are %v files in %v", len(infos), dir)
+	}
+}
+
+func TestFileWriteWithOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "utils-unittest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "a.key")
+	content := "key"
+	uid, gid := strconv.Itoa(os.Getuid()), strconv.Itoa(os.Getgid())
+	err = FileWriteWithOptions(filename, &content, FileOptions{Mode: 0600, User: uid, Group: gid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("file mode is %v, want %v", fi.Mode().Perm(), os.FileMode(0600))
+	}
+	if u, g := FileOwner(fi); strconv.Itoa(u) != uid || strconv.Itoa(g) != gid {
+		t.Fatalf("file owner is %v:%v, want %v:%v", u, g, uid, gid)
+	}
+
+	// the mode asked for replaces the one of the existing file
+	err = FileWriteWithOptions(filename, &content, FileOptions{Mode: 0755})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err = os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0755 {
+		t.Fatalf("file mode is %v, want %v", fi.Mode().Perm(), os.FileMode(0755))
+	}
+
+	err = FileWriteWithOptions(filename, &content, FileOptions{User: "no-such-user-unittest"})
+	if err == nil {
+		t.Fatal("unknown user accepted")
+	}
+	if ret, _ := LoadFile(filename); ret != content {
+		t.Fatalf("ret != content, %v<-->%v", ret, content)
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	body := []byte(`{"code":200}`)
+	newRequest := func() *http.Request {
+		req, _ := http.NewRequest("POST", "http://127.0.0.1/callback", bytes.NewReader(body))
+		return req
+	}
+
+	req := newRequest()
+	SignRequest(req, "secret", body)
+	ret, err := VerifyRequest(req, "secret")
+	if err != nil || string(ret) != string(body) {
+		t.Fatalf("test verify failed, %s %v", ret, err)
+	}
+
+	req = newRequest()
+	SignRequest(req, "secret", body)
+	_, err = VerifyRequest(req, "other")
+	if err != ErrBadSignature {
+		t.Fatalf("test verify failed, wrong secret accepted, %v", err)
+	}
+
+	req = newRequest()
+	_, err = VerifyRequest(req, "secret")
+	if err != ErrNoSignature {
+		t.Fatalf("test verify failed, unsigned request accepted, %v", err)
+	}
+
+	req = newRequest()
+	old := time.Now().Add(-time.Hour).Unix()
+	req.Header.Set(TimestampHeader, strconv.FormatInt(old, 10))
+	req.Header.Set(SignatureHeader, Sign("secret", old, body))
+	_, err = VerifyRequest(req, "secret")
+	if err != ErrBadTimestamp {
+		t.Fatalf("test verify failed, old request accepted, %v", err)
+	}
+}
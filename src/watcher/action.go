@@ -1,13 +1,13 @@
 package watcher
 
 import (
-	"github.com/coreos/etcd/client"
-
-	"encoding/json"
+	"backend"
 	"fmt"
 	"math/rand"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 	"utils"
@@ -18,11 +18,13 @@ var (
 	ExecCmdTimeout = 5 * time.Second
 )
 
-func handleProAction(proPrefix string, watcher *Watcher, exitCh chan bool) {
+// handleProAction queues the events of a project, they are applied in
+// order by the deploy queue.
+func handleProAction(proPrefix string, watcher *Watcher, evCh chan *backend.Event, exitCh chan bool) {
 	xlog.Debug("watch prefix :%v", fmt.Sprintf("%v/%v", proPrefix, EtcdWatchNode))
 	for {
 		select {
-		case resp, ok := <-watcher.respProCh:
+		case resp, ok := <-evCh:
 			if !ok {
 				xlog.Warn("recv from project resp chan failed, channel may be closed. node:%v", fmt.Sprintf("%v/%v", proPrefix, EtcdWatchNode))
 				goto exit
@@ -31,10 +33,11 @@ func handleProAction(proPrefix string, watcher *Watcher, exitCh chan bool) {
 			switch resp.Action {
 			case "get":
 				// TODO: noting
-			case "create", "set", "update":
-				go setAction(watcher, resp)
-			case "delete":
-				go deleteAction(watcher, resp)
+			case backend.ActionCreate, backend.ActionSet, backend.ActionUpdate, backend.ActionDelete:
+				watcher.queue.push(proPrefix, resp)
+			case backend.ActionResync:
+				// events were lost, re-list and deploy the whole project
+				watcher.queue.push(proPrefix, resp)
 			}
 		case <-exitCh:
 			goto exit
@@ -45,21 +48,33 @@ exit:
 	xlog.Debug("cannel watch prefix :%v", fmt.Sprintf("%v/%v", proPrefix, EtcdWatchNode))
 }
 
-func setAction(w *Watcher, resp *client.Response) {
+// deploy applies the events of a project with a single run of beforeCmd
+// and afterCmd, and sends one callback listing every file.
+func deploy(w *Watcher, proPrefix string, evs []*backend.Event) {
 	var (
-		err       error
-		filename  string
-		config    Config
-		beforeCmd Cmd
-		afterCmd  Cmd
+		err         error
+		config      Config
+		files       []File
+		validateCmd Cmd
+		beforeCmd   Cmd
+		afterCmd    Cmd
+		rollbackCmd Cmd
+		rolledBack  bool
+		deployID    = newID()
+		startedAt   = time.Now()
 	)
 	// recover for the last time
 	defer func() {
-		if revErr := recover(); err != nil {
-			xlog.Fatal("setAction: recover is err, err:%v", revErr)
+		if revErr := recover(); revErr != nil {
+			xlog.Fatal("deploy: recover is err, err:%v", revErr)
 		}
 	}()
 
+	evs = compactEvents(w.resolveLayers(proPrefix, evs))
+	if len(evs) == 0 {
+		return
+	}
+
 	// callback
 	defer func() {
 		if len(config.Callback) == 0 {
@@ -71,224 +86,504 @@ func setAction(w *Watcher, resp *client.Response) {
 		var msg string
 		if err != nil {
 			code = http.StatusInternalServerError
+			if _, ok := err.(*RejectError); ok {
+				code = http.StatusForbidden
+			}
 			msg = err.Error()
 		} else {
 			code = http.StatusOK
 		}
 
-		if beforeCmd.Err != nil {
-			beforeCmd.Msg = beforeCmd.Err.Error()
+		response := &Response{
+			SchemaVersion: ResponseSchemaVersion,
+			DeployID:      deployID,
+			Hostname:      w.cfg.Hostname,
+			Project:       fileName(proPrefix),
+			DeployPath:    config.DeployPath,
+			StartedAt:     startedAt,
+			FinishedAt:    time.Now(),
+
+			Code:        code,
+			Msg:         msg,
+			ValidateCmd: validateCmd,
+			BeforeCmd:   beforeCmd,
+			AfterCmd:    afterCmd,
+			RolledBack:  rolledBack,
+			RollbackCmd: rollbackCmd,
+			Files:       files,
 		}
-		if afterCmd.Err != nil {
-			afterCmd.Msg = afterCmd.Err.Error()
+		for _, ev := range evs {
+			if ev.Index > response.Index {
+				response.Index = ev.Index
+			}
 		}
-		response := &Response{
-			Code:      code,
-			Msg:       msg,
-			MD5:       utils.GetMD5Hash(resp.Node.Value),
-			BeforeCmd: beforeCmd,
-			AfterCmd:  afterCmd,
+		// a single event is reported like before batching
+		if len(evs) == 1 {
+			response.Key = evs[0].Key
+			response.Action = evs[0].Action
+			if evs[0].Action != backend.ActionDelete {
+				response.MD5 = utils.GetMD5Hash(evs[0].Value)
+			}
+		} else {
+			response.Action = ActionBatch
 		}
-		response.Action = resp.Action
-		respErr = response.Callback(config.Callback)
-		if respErr != nil {
-			xlog.Fatal("setAction callback: response.Callback is err, err:%v", respErr)
+		secret := w.callbackSecret(&config)
+		// every sink gets its own delivery of the same response
+		for _, sink := range config.Callback {
+			response.DeliveryID = newID()
+			if w.outbox != nil && sink.Policy == PolicyRetry {
+				respErr = w.outbox.add(sink, proPrefix, response)
+			} else {
+				var body []byte
+				body, respErr = response.Encode()
+				if respErr == nil {
+					respErr = deliver(sink.URL, body, response.DeliveryID, secret, sink.timeout)
+				}
+			}
+			if respErr != nil {
+				xlog.Fatal("deploy callback: callback to %v is err, err:%v", sink.URL, respErr)
+			}
 		}
 	}()
 
 	// get project config from etcd
-	proPrefix := trimProPrefix(resp.Node.Key, w.cfg.Prefix)
-	prefix, conf, err := w.getConfig(proPrefix)
+	config, err = w.loadConfig(proPrefix)
 	if err != nil {
-		xlog.Warn("setAction getConfig: node:%v, err:%v", prefix, err)
+		xlog.Warn("deploy loadConfig: project:%v, err:%v", proPrefix, err)
 		return
 	}
-	err = json.Unmarshal(conf, &config)
+
+	// the file and unix sinks only reach under the sink roots of the host
+	config.Callback, err = checkSinks(w.cfg.SinkRoots, config.Callback)
 	if err != nil {
-		xlog.Warn("setAction json.Unmarshal: node:%v, err:%v", prefix, err)
+		xlog.Warn("deploy: project:%v, err:%v", proPrefix, err)
 		return
 	}
-	err = config.checkConfig()
+
+	// the project only writes under the allowed roots of the host
+	config.DeployPath, err = checkDeployPath(w.cfg.AllowedRoots, config.DeployPath)
+	if err == nil && len(config.BackupDir) > 0 {
+		config.BackupDir, err = checkDeployPath(w.cfg.AllowedRoots, config.BackupDir)
+	}
 	if err != nil {
-		xlog.Warn("setAction checkConfig: node:%v, err:%v", prefix, err)
+		xlog.Warn("deploy: project:%v, err:%v", proPrefix, err)
 		return
 	}
 
-	strarr := strings.Split(resp.Node.Key, "/")
-	filename = strarr[len(strarr)-1]
-	if len(filename) == 0 {
-		xlog.Warn("setAction: file name is null, action:%v", resp.Action)
-		return
+	// the hosts with a [hooks] section only run the hooks listed there
+	hooks := []struct {
+		hook *Hook
+		cmd  *Cmd
+	}{
+		{&config.ValidateCmd, &validateCmd},
+		{&config.BeforeCmd, &beforeCmd},
+		{&config.AfterCmd, &afterCmd},
 	}
-
-	if !utils.FileExists(config.DeployPath) {
-		err = os.MkdirAll(config.DeployPath, 0755)
-		if err != nil {
-			xlog.Warn("setAction: os.Mkdir is err, action:%v, err:%v", resp.Action, err)
-			return
+	for _, h := range hooks {
+		hook, hookErr := allowHook(w.cfg.Hooks, *h.hook)
+		if hookErr != nil {
+			xlog.Warn("deploy: project:%v, err:%v", proPrefix, hookErr)
+			*h.cmd = refusedCmd(hookErr)
+			if err == nil {
+				err = hookErr
+			}
+			continue
 		}
+		*h.hook = hook
 	}
-
-	path := config.DeployPath
-	if !strings.HasSuffix(path, "/") {
-		path = path + "/"
-	}
-	file := path + filename
-	xlog.Debug("setAction: write to %v", file)
-
-	// publish before
-	beforeCmd.Success, beforeCmd.Out, beforeCmd.Err = runCmd(config.BeforeCmd)
-
-	err = utils.FileWrite(file, &resp.Node.Value)
 	if err != nil {
-		xlog.Warn("setAction: utils.FileWrite is err, action:%v, err:%v", resp.Action, err)
+		return
 	}
 
-	// publish after
-	afterCmd.Success, afterCmd.Out, afterCmd.Err = runCmd(config.AfterCmd)
-
-	return
-}
-
-func deleteAction(w *Watcher, resp *client.Response) {
+	// resolve the files first, the commands aren't run for nothing
 	var (
-		err       error
-		filename  string
-		config    Config
-		beforeCmd Cmd
-		afterCmd  Cmd
+		todo      []*backend.Event
+		data      *templateData
+		unchanged int
 	)
+	for i, ev := range evs {
+		rel := relPath(proPrefix, ev.Key)
+		if len(rel) == 0 {
+			xlog.Warn("deploy: file name is null, action:%v, key:%v", ev.Action, ev.Key)
+			continue
+		}
+		if ev.Dir && ev.Action != backend.ActionDelete {
+			// the dirs are made along with their files
+			xlog.Debug("deploy: skip dir, action:%v, key:%v", ev.Action, ev.Key)
+			continue
+		}
+		tmpl := isTemplate(&config, rel)
+		if tmpl {
+			rel = strings.TrimSuffix(rel, TemplateSuffix)
+		}
+		file, fileErr := checkFile(config.DeployPath, rel)
+		if fileErr != nil {
+			// nothing is deployed with a bad key
+			err = fileErr
+			xlog.Warn("deploy: project:%v, key:%v, err:%v", proPrefix, ev.Key, err)
+			files = append(files, File{Key: ev.Key, Action: ev.Action, Index: ev.Index, Msg: err.Error()})
+			continue
+		}
+		if ev.Action == backend.ActionDelete && !utils.FileExists(file) {
+			xlog.Warn("deploy: file doesn't exist, action:%v, file:%v", ev.Action, file)
+			continue
+		}
+		if tmpl && ev.Action != backend.ActionDelete {
+			if data == nil {
+				var dataErr error
+				data, dataErr = w.templateData(proPrefix)
+				if dataErr != nil {
+					err = dataErr
+					xlog.Warn("deploy: templateData is err, project:%v, err:%v", proPrefix, err)
+					return
+				}
+			}
+			out, renderErr := render(ev.Key, ev.Value, data)
+			if renderErr != nil {
+				err = renderErr
+				xlog.Warn("deploy: render is err, project:%v, key:%v, err:%v", proPrefix, ev.Key, err)
+				files = append(files, File{Key: ev.Key, Action: ev.Action, Path: file, Index: ev.Index, Msg: err.Error()})
+				continue
+			}
+			// the event is shared with the queue
+			rendered := *ev
+			rendered.Value = out
+			ev = &rendered
+			evs[i] = ev
+		}
+		f := File{Key: ev.Key, Action: ev.Action, Path: file, Index: ev.Index}
+		if ev.Action != backend.ActionDelete {
+			f.MD5 = utils.GetMD5Hash(ev.Value)
+			f.Size = int64(len(ev.Value))
+			if isDir, _ := utils.IsDir(file); isDir {
+				err = fmt.Errorf("%v is a dir", file)
+				xlog.Warn("deploy: project:%v, key:%v, err:%v", proPrefix, ev.Key, err)
+				f.Msg = err.Error()
+			}
+		}
+		if prev, readErr := utils.LoadFile(file); readErr == nil {
+			f.PrevMD5 = utils.GetMD5Hash(prev)
+		}
+		// new vars don't change every template
+		if ev.Action == ActionRender && f.MD5 == f.PrevMD5 && len(f.Msg) == 0 {
+			unchanged++
+			continue
+		}
+		todo = append(todo, ev)
+		files = append(files, f)
+	}
+	if err != nil || len(todo) == 0 {
+		if err == nil && unchanged > 0 {
+			xlog.Debug("deploy: project:%v, templates unchanged:%v", proPrefix, unchanged)
+			config.Callback = nil
+		}
+		return
+	}
 
-	// recover for the last time
-	defer func() {
-		if revErr := recover(); err != nil {
-			xlog.Fatal("deleteAction: recover is err, err:%v", revErr)
+	if !utils.FileExists(config.DeployPath) {
+		err = os.MkdirAll(config.DeployPath, 0755)
+		if err != nil {
+			xlog.Warn("deploy: os.Mkdir is err, project:%v, err:%v", proPrefix, err)
+			return
 		}
-	}()
+	}
 
-	// callback
-	defer func() {
-		if len(config.Callback) == 0 {
+	// check the files in a staged copy of deployPath first
+	env := deployEnv(w, proPrefix, evs, files)
+	if !config.ValidateCmd.IsEmpty() {
+		stageDir, stageFile, stageErr := stageFiles(&config, todo, files)
+		if stageErr == nil {
+			stageErr = openStageDir(stageDir, config.cmdOptions(nil))
+			if stageErr != nil {
+				os.RemoveAll(stageDir)
+			}
+		}
+		if stageErr != nil {
+			err = stageErr
+			xlog.Warn("deploy: stageFiles is err, project:%v, err:%v", proPrefix, err)
 			return
 		}
+		validateCmd = runCmd(expandStage(config.ValidateCmd, stageDir, stageFile),
+			config.cmdOptions(append(env, "WATCHER_STAGE_DIR="+stageDir, "WATCHER_STAGE_FILE="+stageFile)))
+		os.RemoveAll(stageDir)
+		if !validateCmd.Success {
+			err = fmt.Errorf("validateCmd failed, deploy refused")
+			xlog.Warn("deploy: validateCmd is failed, project:%v, stderr:%v", proPrefix, validateCmd.Stderr)
+			return
+		}
+	}
 
-		var respErr error
-		var code int
-		var msg string
+	// keep the current files to put them back when the deploy fails
+	var snaps []snapshot
+	if config.RollbackOnFailure {
+		paths := make([]string, len(files))
+		for i := range files {
+			paths[i] = files[i].Path
+		}
+		snaps, err = takeSnapshots(paths)
 		if err != nil {
-			code = http.StatusInternalServerError
-			msg = err.Error()
-		} else {
-			code = http.StatusOK
+			xlog.Warn("deploy: takeSnapshots is err, project:%v, err:%v", proPrefix, err)
+			return
 		}
+	}
 
-		if beforeCmd.Err != nil {
-			beforeCmd.Msg = beforeCmd.Err.Error()
+	// the files deployed before, to find the ones left by lost events
+	manifest := manifestPath(config.DeployPath, proPrefix)
+	deployed := loadManifest(manifest)
+	recordFiles := func(applied bool) {
+		rels := make(map[string]bool, len(deployed))
+		for rel := range deployed {
+			rels[rel] = true
 		}
-		if afterCmd.Err != nil {
-			afterCmd.Msg = afterCmd.Err.Error()
+		if applied {
+			updateManifest(rels, config.DeployPath, files)
 		}
-		response := &Response{
-			Code:      code,
-			Msg:       msg,
-			MD5:       "",
-			BeforeCmd: beforeCmd,
-			AfterCmd:  afterCmd,
+		for rel := range rels {
+			if !utils.FileExists(filepath.Join(config.DeployPath, filepath.FromSlash(rel))) {
+				delete(rels, rel)
+			}
 		}
-		response.Action = resp.Action
-		respErr = response.Callback(config.Callback)
-		if respErr != nil {
-			xlog.Fatal("deleteAction callback: response.Callback is err, err:%v", respErr)
+		if saveErr := saveManifest(manifest, rels); saveErr != nil {
+			xlog.Warn("deploy: saveManifest is err, project:%v, err:%v", proPrefix, saveErr)
 		}
-	}()
+	}
 
-	// get project config from etcd
-	proPrefix := trimProPrefix(resp.Node.Key, w.cfg.Prefix)
-	prefix, conf, err := w.getConfig(proPrefix)
-	if err != nil {
-		xlog.Warn("deleteAction getConfig: node:%v, err:%v", prefix, err)
-		return
+	// publish before
+	beforeCmd = runCmd(config.BeforeCmd, config.cmdOptions(env))
+
+	for i, ev := range todo {
+		var fileErr error
+		if ev.Action == backend.ActionDelete {
+			fileErr = applyDelete(&config, files[i].Path)
+		} else {
+			xlog.Debug("deploy: write to %v", files[i].Path)
+			fileErr = os.MkdirAll(filepath.Dir(files[i].Path), 0755)
+			if fileErr == nil {
+				rel, _ := filepath.Rel(config.DeployPath, files[i].Path)
+				opt := config.fileOptions(filepath.ToSlash(rel))
+				fileErr = utils.FileWriteWithOptions(files[i].Path, &ev.Value, opt)
+			}
+			if fi, statErr := os.Stat(files[i].Path); fileErr == nil && statErr == nil {
+				uid, gid := utils.FileOwner(fi)
+				files[i].Mode = fmt.Sprintf("%04o", fi.Mode().Perm())
+				files[i].Owner = fmt.Sprintf("%d:%d", uid, gid)
+			}
+		}
+		if fileErr != nil {
+			xlog.Warn("deploy: apply is err, action:%v, file:%v, err:%v", ev.Action, files[i].Path, fileErr)
+			files[i].Msg = fileErr.Error()
+			if err == nil {
+				err = fileErr
+			}
+		}
 	}
-	err = json.Unmarshal(conf, &config)
+	// the files aren't complete, don't reload with them. Put back, the
+	// previous files are reloaded to leave the state of beforeCmd
 	if err != nil {
-		xlog.Warn("deleteAction json.Unmarshal: node:%v, err:%v", prefix, err)
+		if config.RollbackOnFailure {
+			rolledBack = restoreSnapshots(snaps) == nil
+			pruneFileDirs(config.DeployPath, files)
+		}
+		if !rolledBack {
+			recordFiles(true)
+			return
+		}
+		rollbackCmd = runCmd(config.AfterCmd, config.cmdOptions(env))
 		return
 	}
+	pruneFileDirs(config.DeployPath, files)
+	recordFiles(true)
 
-	strarr := strings.Split(resp.Node.Key, "/")
-	filename = strarr[len(strarr)-1]
-	if len(filename) == 0 {
-		xlog.Warn("deleteAction: filename is null, action:%v", resp.Action)
-		return
+	// publish after
+	afterCmd = runCmd(config.AfterCmd, config.cmdOptions(env))
+	if !afterCmd.Success && config.RollbackOnFailure {
+		err = fmt.Errorf("afterCmd failed, files rolled back")
+		xlog.Warn("deploy: afterCmd is failed, project:%v, rollback", proPrefix)
+		restoreErr := restoreSnapshots(snaps)
+		if restoreErr != nil {
+			err = fmt.Errorf("afterCmd failed, rollback is err, err:%v", restoreErr)
+			return
+		}
+		pruneFileDirs(config.DeployPath, files)
+		rolledBack = true
+		recordFiles(false)
+		// reload the previous files
+		rollbackCmd = runCmd(config.AfterCmd, config.cmdOptions(env))
 	}
 
-	path := config.DeployPath
-	if !strings.HasSuffix(path, "/") {
-		path = path + "/"
-	}
-	file := path + filename
-	if !utils.FileExists(file) {
-		xlog.Warn("deleteAction: file doesn't exist, action:%v", resp.Action)
-		return
+	return
+}
+
+// callbackSecret returns the key signing the callbacks of the project.
+func (w *Watcher) callbackSecret(config *Config) string {
+	if len(config.Secret) > 0 {
+		return config.Secret
 	}
+	return w.cfg.Secret
+}
 
-	// publish before
-	beforeCmd.Success, beforeCmd.Out, beforeCmd.Err = runCmd(config.BeforeCmd)
+// projectSecret is callbackSecret by the current config of the project,
+// the one of the host when it can't be read.
+func (w *Watcher) projectSecret(proPrefix string) string {
+	config, err := w.loadConfig(proPrefix)
+	if err != nil {
+		xlog.Warn("projectSecret: loadConfig is err, project:%v, err:%v", proPrefix, err)
+		return w.cfg.Secret
+	}
+	return w.callbackSecret(&config)
+}
 
+// applyDelete removes the file or the dir with its files, or moves it to
+// the backup dir when the project has one.
+func applyDelete(config *Config, file string) (err error) {
 	// when backup dir is null that will remove the config file
 	// when backup dir is seted that will backup the config file to backup dir
 	if len(config.BackupDir) == 0 {
-		err = os.Remove(file)
+		err = os.RemoveAll(file)
 		if err != nil {
-			xlog.Warn("deleteAction: os.Remove is err, action:%v, err:%v", resp.Action, err)
 			return
 		}
-		xlog.Debug("deleteAction: remove file %v", file)
-	} else {
-		isExists := utils.FileExists(config.BackupDir)
-		if !isExists {
-			err = os.MkdirAll(config.BackupDir, 0755)
-			if err != nil {
-				xlog.Warn("deleteAction: os.MkdirAll is err, action:%v, err:%v", resp.Action, err)
-				return
-			}
-		}
-		isdir, err := utils.IsDir(config.BackupDir)
+		xlog.Debug("applyDelete: remove file %v", file)
+		return
+	}
+
+	isExists := utils.FileExists(config.BackupDir)
+	if !isExists {
+		err = os.MkdirAll(config.BackupDir, 0755)
 		if err != nil {
-			xlog.Warn("deleteAction: utils.IsDir is err, action:%v, err:%v", resp.Action, err)
 			return
 		}
-		if !isdir {
-			xlog.Warn("deleteAction: config.BackupDir is not a dir, action:%v, err:%v", resp.Action, err)
+	}
+	isdir, err := utils.IsDir(config.BackupDir)
+	if err != nil {
+		return
+	}
+	if !isdir {
+		err = fmt.Errorf("backupDir %v is not a dir", config.BackupDir)
+		return
+	}
+	timestamp := time.Now().Unix()
+	tm := time.Unix(timestamp, 0)
+	newfile := fmt.Sprintf("%v/%v_watcherbackup_%v_%v", config.BackupDir, fileName(file), tm.Format(TimeFormat), rand.Int63())
+	err = os.Rename(file, newfile)
+	if err != nil {
+		return
+	}
+	xlog.Debug("applyDelete: backup file %v to %v", file, newfile)
+	return
+}
+
+// compactEvents keeps the last event of every key, in the order of
+// those last events.
+func compactEvents(evs []*backend.Event) []*backend.Event {
+	last := make(map[string]int)
+	for i, ev := range evs {
+		last[ev.Key] = i
+	}
+	var res []*backend.Event
+	for i, ev := range evs {
+		if last[ev.Key] == i {
+			res = append(res, ev)
 		}
-		timestamp := time.Now().Unix()
-		tm := time.Unix(timestamp, 0)
-		newfile := fmt.Sprintf("%v/%v_watcherbackup_%v_%v", config.BackupDir, filename, tm.Format(TimeFormat), rand.Int63())
-		err = os.Rename(file, newfile)
-		if err != nil {
-			xlog.Warn("deleteAction: os.Rename is err, action:%v, err:%v", resp.Action, err)
+	}
+	return res
+}
+
+// pruneFileDirs removes the dirs of the files left empty by the deploy.
+func pruneFileDirs(deployPath string, files []File) {
+	for _, f := range files {
+		if len(f.Path) > 0 {
+			pruneDirs(deployPath, filepath.Dir(f.Path))
 		}
-		xlog.Debug("deleteAction: backup file %v to %v", file, newfile)
 	}
+}
 
-	// publish after
-	afterCmd.Success, afterCmd.Out, afterCmd.Err = runCmd(config.AfterCmd)
+// relPath returns the path of the key under the config.d of the project,
+// in any of its layers, which is also its path under deployPath.
+func relPath(proPrefix, key string) string {
+	node := fmt.Sprintf("/%s/%s/", fileName(proPrefix), EtcdWatchNode)
+	key = squashSlashes(key)
+	i := strings.Index(key, node)
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimSuffix(key[i+len(node):], "/")
+}
 
-	return
+// squashSlashes turns the runs of slashes into one, the backends don't
+// keep them in the keys.
+func squashSlashes(key string) string {
+	for strings.Contains(key, "//") {
+		key = strings.Replace(key, "//", "/", -1)
+	}
+	return key
+}
+
+func fileName(key string) string {
+	strarr := strings.Split(key, "/")
+	return strarr[len(strarr)-1]
 }
 
-func runCmd(cmd string) (bool, string, error) {
-	if len(cmd) == 0 {
-		return true, "", nil
+// deployEnv describes the deploy to the commands, the files of a batch
+// are separated by spaces and the index is the highest one.
+func deployEnv(w *Watcher, proPrefix string, evs []*backend.Event, files []File) []string {
+	var (
+		paths []string
+		keys  []string
+		md5s  []string
+		index uint64
+	)
+	for _, f := range files {
+		paths = append(paths, f.Path)
+		keys = append(keys, f.Key)
+		md5s = append(md5s, f.MD5)
+	}
+	for _, ev := range evs {
+		if ev.Index > index {
+			index = ev.Index
+		}
 	}
+	action := ActionBatch
+	if len(evs) == 1 {
+		action = evs[0].Action
+	}
+	return []string{
+		"WATCHER_PROJECT=" + fileName(proPrefix),
+		"WATCHER_ACTION=" + action,
+		"WATCHER_FILE=" + strings.Join(paths, " "),
+		"WATCHER_KEY=" + strings.Join(keys, " "),
+		"WATCHER_MD5=" + strings.Join(md5s, " "),
+		"WATCHER_ETCD_INDEX=" + strconv.FormatUint(index, 10),
+		"WATCHER_HOST=" + w.cfg.Hostname,
+	}
+}
 
-	cmdArgs := strings.Split(cmd, " ")
-	name := cmdArgs[0]
-	args := cmdArgs[1:]
+func runCmd(hook Hook, opt utils.CmdOptions) (cmd Cmd) {
+	if hook.IsEmpty() {
+		cmd.Success = true
+		return
+	}
 
-	cmdSuccess, out, cmdErr := utils.Command(ExecCmdTimeout, name, args...)
-	cmdOut := string(out)
-	return cmdSuccess, cmdOut, cmdErr
+	name, args := hook.argv()
+	res, err := utils.CommandWithOptions(opt, name, args...)
+	cmd.Success = res.Success
+	cmd.Stdout = string(res.Stdout)
+	cmd.Stderr = string(res.Stderr)
+	cmd.Out = cmd.Stdout
+	cmd.Truncated = res.Truncated
+	cmd.StartedAt = res.StartedAt
+	cmd.DurationMs = int64(res.Duration / time.Millisecond)
+	cmd.TimedOut = res.TimedOut
+	cmd.ExitCode = res.ExitCode
+	cmd.Signal = res.Signal
+	if err != nil {
+		cmd.Err = err.Error()
+		cmd.Msg = cmd.Err
+	}
+	if res.TimedOut {
+		cmd.Msg = fmt.Sprintf("timed out after %v, %v", opt.Timeout, cmd.Msg)
+	}
+	return
 }
 
 func init() {
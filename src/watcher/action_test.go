@@ -1,16 +1,23 @@
 package watcher
 
 import (
+	"backend"
 	"fmt"
-	"github.com/coreos/etcd/client"
 	"log"
 	"testing"
 	"time"
 
 	"encoding/json"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"utils"
 	"utils/xlog"
 )
@@ -39,8 +46,10 @@ var (
 		proxy_busy_buffers_size 128k;
 		proxy_temp_file_write_size 128k;`
 
+	// the filesystem backend runs the scenarios without a live etcd
 	cfg = Cfg{
-		Endpoints:   "localhost:2379",
+		Backend:     BackendFilesystem,
+		Root:        filepath.Join(os.TempDir(), "watcher-unittest"),
 		DialTimeout: 5 * time.Second,
 		Hostname:    hostname,
 		Username:    "",
@@ -89,8 +98,7 @@ func TestDeleteAction(t *testing.T) {
 
 	// exec delete
 	ngxConfPerfix := fmt.Sprintf("%s/%s", proWatchPrefix, ngxName)
-	opts := &client.DeleteOptions{Recursive: true}
-	err = w.client.Delete(ngxConfPerfix, opts)
+	err = w.client.Delete(ngxConfPerfix, true)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -118,6 +126,1245 @@ func TestDeleteAction(t *testing.T) {
 
 }
 
+func TestDeployQueue(t *testing.T) {
+	var err error
+
+	// a project without callback, the events are pushed by hand
+	queuePrefix := prefix + "queue"
+	queueConf := `{"deployPath": "/tmp/watcher-queue", "callback": ""}`
+	err = w.client.Update(fmt.Sprintf("%v/%v", queuePrefix, EtcdConfigNode), []byte(queueConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll("/tmp/watcher-queue")
+
+	key := fmt.Sprintf("%v/%v/%v", queuePrefix, EtcdWatchNode, ngxName)
+	for i := 1; i <= 20; i++ {
+		w.queue.push(queuePrefix, &backend.Event{Action: backend.ActionSet, Key: key, Value: fmt.Sprintf("v%d", i), Index: uint64(i)})
+	}
+	// replayed after the newer ones, must not overwrite them
+	w.queue.push(queuePrefix, &backend.Event{Action: backend.ActionSet, Key: key, Value: "stale", Index: 10})
+
+	// wait until the last event is applied
+	var ret string
+	for i := 0; i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+		ret, err = utils.LoadFile("/tmp/watcher-queue/" + ngxName)
+		if err == nil && ret == "v20" {
+			break
+		}
+	}
+	if depth := w.queue.Depth(); depth != 0 {
+		t.Fatalf("test deploy queue failed, depth:%v", depth)
+	}
+	if ret != "v20" {
+		t.Fatalf("test deploy queue failed, not expected data, %v<-->%v", ret, "v20")
+	}
+	w.client.Delete(queuePrefix, true)
+}
+
+func TestBatchDeploy(t *testing.T) {
+	var err error
+
+	ts, respCh := newCallbackServer()
+	defer ts.Close()
+
+	batchPrefix := prefix + "batch"
+	batchConf := fmt.Sprintf(`{"deployPath": "/tmp/watcher-batch", "callback": "%v", "batchWindow": "300ms"}`, ts.URL)
+	err = w.client.Update(fmt.Sprintf("%v/%v", batchPrefix, EtcdConfigNode), []byte(batchConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.client.Delete(batchPrefix, true)
+	os.RemoveAll("/tmp/watcher-batch")
+
+	for i := 1; i <= 5; i++ {
+		key := fmt.Sprintf("%v/%v/%d.conf", batchPrefix, EtcdWatchNode, i)
+		w.queue.push(batchPrefix, &backend.Event{Action: backend.ActionSet, Key: key, Value: fmt.Sprintf("v%d", i), Index: uint64(i)})
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	select {
+	case response := <-respCh:
+		if response.Action != ActionBatch || len(response.Files) != 5 {
+			t.Fatalf("test batch deploy failed, not expected response, %+v", response)
+		}
+		if response.Files[4].MD5 != utils.GetMD5Hash("v5") {
+			t.Fatalf("test batch deploy failed, md5 doesn't match, %+v", response.Files[4])
+		}
+		if response.SchemaVersion != ResponseSchemaVersion || len(response.DeployID) == 0 || response.Hostname != hostname ||
+			response.Project != "batch" || response.Index != 5 || response.FinishedAt.Before(response.StartedAt) {
+			t.Fatalf("test batch deploy failed, not expected response, %+v", response)
+		}
+		if f := response.Files[4]; f.Index != 5 || f.Size != 2 || len(f.PrevMD5) != 0 {
+			t.Fatalf("test batch deploy failed, not expected file, %+v", f)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("test batch deploy failed, no callback")
+	}
+	select {
+	case response := <-respCh:
+		t.Fatalf("test batch deploy failed, more than one callback, %+v", response)
+	case <-time.After(time.Second):
+	}
+}
+
+func TestRollbackOnFailure(t *testing.T) {
+	var err error
+
+	ts, respCh := newCallbackServer()
+	defer ts.Close()
+
+	rbPrefix := prefix + "rollback"
+	// the deploy widens the mode, the rollback puts the old one back
+	rbConf := fmt.Sprintf(`{"deployPath": "/tmp/watcher-rollback", "afterCmd": "false", "callback": "%v", "rollbackOnFailure": true,
+		"files": [{"pattern": "a.conf", "mode": "0644"}]}`, ts.URL)
+	err = w.client.Update(fmt.Sprintf("%v/%v", rbPrefix, EtcdConfigNode), []byte(rbConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.client.Delete(rbPrefix, true)
+	os.RemoveAll("/tmp/watcher-rollback")
+	os.MkdirAll("/tmp/watcher-rollback", 0755)
+	err = ioutil.WriteFile("/tmp/watcher-rollback/a.conf", []byte("old"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyPrefix := fmt.Sprintf("%v/%v", rbPrefix, EtcdWatchNode)
+	deploy(w, rbPrefix, []*backend.Event{
+		{Action: backend.ActionSet, Key: keyPrefix + "/a.conf", Value: "new", Index: 1},
+		{Action: backend.ActionCreate, Key: keyPrefix + "/b.conf", Value: "new", Index: 2},
+	})
+
+	select {
+	case response := <-respCh:
+		if !response.RolledBack || response.Code != http.StatusInternalServerError || response.AfterCmd.Success {
+			t.Fatalf("test rollback failed, not expected response, %+v", response)
+		}
+		if response.Files[0].PrevMD5 != utils.GetMD5Hash("old") || response.Files[0].Mode != "0644" {
+			t.Fatalf("test rollback failed, not expected previous md5, %+v", response.Files[0])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("test rollback failed, no callback")
+	}
+	ret, err := utils.LoadFile("/tmp/watcher-rollback/a.conf")
+	if err != nil || ret != "old" {
+		t.Fatalf("test rollback failed, a.conf not restored, %v %v", ret, err)
+	}
+	fi, err := os.Stat("/tmp/watcher-rollback/a.conf")
+	if err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("test rollback failed, mode not restored, %v", err)
+	}
+	if utils.FileExists("/tmp/watcher-rollback/b.conf") {
+		t.Fatal("test rollback failed, b.conf not removed")
+	}
+}
+
+func TestRollbackOnWriteFailure(t *testing.T) {
+	ts, respCh := newCallbackServer()
+	defer ts.Close()
+
+	dir := "/tmp/watcher-rollback-write"
+	os.RemoveAll(dir)
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "a.conf"), []byte("old"), 0644)
+
+	rbPrefix := prefix + "rollback-write"
+	rbConf := fmt.Sprintf(`{"deployPath": %q, "beforeCmd": "rm -f %v/reloaded", "afterCmd": "touch %v/reloaded",
+		"callback": "%v", "rollbackOnFailure": true,
+		"files": [{"pattern": "b.conf", "user": "no-such-user-unittest"}]}`, dir, dir, dir, ts.URL)
+	err := w.client.Update(fmt.Sprintf("%v/%v", rbPrefix, EtcdConfigNode), []byte(rbConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.client.Delete(rbPrefix, true)
+
+	keyPrefix := fmt.Sprintf("%v/%v", rbPrefix, EtcdWatchNode)
+	deploy(w, rbPrefix, []*backend.Event{
+		{Action: backend.ActionSet, Key: keyPrefix + "/a.conf", Value: "new", Index: 1},
+		{Action: backend.ActionCreate, Key: keyPrefix + "/b.conf", Value: "new", Index: 2},
+	})
+
+	// the files of before are back and reloaded
+	select {
+	case response := <-respCh:
+		if !response.RolledBack || response.Code != http.StatusInternalServerError || !response.RollbackCmd.Success {
+			t.Fatalf("test rollback on write failure failed, not expected response, %+v", response)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("test rollback on write failure failed, no callback")
+	}
+	if ret, _ := utils.LoadFile(filepath.Join(dir, "a.conf")); ret != "old" {
+		t.Fatalf("test rollback on write failure failed, a.conf not restored, %v", ret)
+	}
+	if utils.FileExists(filepath.Join(dir, "b.conf")) {
+		t.Fatal("test rollback on write failure failed, b.conf not removed")
+	}
+	if !utils.FileExists(filepath.Join(dir, "reloaded")) {
+		t.Fatal("test rollback on write failure failed, afterCmd not run")
+	}
+}
+
+func TestValidateCmd(t *testing.T) {
+	var err error
+
+	ts, respCh := newCallbackServer()
+	defer ts.Close()
+
+	vPrefix := prefix + "validate"
+	vConf := fmt.Sprintf(`{"deployPath": "/tmp/watcher-validate", "validateCmd": "test -s {stageFile}", "callback": "%v"}`, ts.URL)
+	err = w.client.Update(fmt.Sprintf("%v/%v", vPrefix, EtcdConfigNode), []byte(vConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.client.Delete(vPrefix, true)
+	os.RemoveAll("/tmp/watcher-validate")
+
+	key := fmt.Sprintf("%v/%v/a.conf", vPrefix, EtcdWatchNode)
+	steps := []struct {
+		value   string
+		success bool
+	}{
+		{"", false},
+		{"valid", true},
+	}
+	for _, step := range steps {
+		deploy(w, vPrefix, []*backend.Event{{Action: backend.ActionSet, Key: key, Value: step.value}})
+		select {
+		case response := <-respCh:
+			if response.ValidateCmd.Success != step.success {
+				t.Fatalf("test validateCmd failed, not expected response, %+v", response)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("test validateCmd failed, no callback")
+		}
+		if utils.FileExists("/tmp/watcher-validate/a.conf") != step.success {
+			t.Fatalf("test validateCmd failed, file deployed:%v", !step.success)
+		}
+	}
+}
+
+func TestStageFiles(t *testing.T) {
+	dir := "/tmp/watcher-stage"
+	os.RemoveAll(dir)
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "old.conf"), []byte("old"), 0640)
+
+	var c Config
+	err := json.Unmarshal([]byte(`{"deployPath": "/tmp/watcher-stage", "files": [{"pattern": "*.key", "mode": "0600"}]}`), &c)
+	if err == nil {
+		err = c.checkConfig()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only root may give the stage dir away
+	if os.Geteuid() == 0 {
+		c.RunAs = "nobody"
+	}
+	evs := []*backend.Event{
+		{Action: backend.ActionSet, Value: "key"},
+		{Action: backend.ActionSet, Value: "new"},
+	}
+	files := []File{{Path: filepath.Join(dir, "ssl/a.key")}, {Path: filepath.Join(dir, "new.conf")}}
+	stageDir, _, err := stageFiles(&c, evs, files)
+	if err != nil {
+		t.Fatalf("test stageFiles failed, %v", err)
+	}
+	defer os.RemoveAll(stageDir)
+
+	modes := map[string]os.FileMode{"": 0700, "old.conf": 0640, "ssl/a.key": 0600, "new.conf": 0644}
+	for rel, mode := range modes {
+		fi, err := os.Stat(filepath.Join(stageDir, rel))
+		if err != nil || fi.Mode().Perm() != mode {
+			t.Fatalf("test stageFiles failed, not expected mode of %q, %v %v", rel, fi, err)
+		}
+	}
+	// the stage dir belongs to root until it's filled, then to runAs
+	fi, _ := os.Stat(stageDir)
+	if owner, _ := utils.FileOwner(fi); owner != os.Geteuid() {
+		t.Fatalf("test stageFiles failed, stage dir owned by %v while filled", owner)
+	}
+	err = openStageDir(stageDir, c.cmdOptions(nil))
+	if err != nil {
+		t.Fatalf("test openStageDir failed, %v", err)
+	}
+	if len(c.RunAs) > 0 {
+		fi, _ = os.Stat(stageDir)
+		uid, _, _ := utils.LookupOwner("nobody", "")
+		if owner, _ := utils.FileOwner(fi); owner != uid {
+			t.Fatalf("test openStageDir failed, stage dir owned by %v", owner)
+		}
+	}
+}
+
+func TestHook(t *testing.T) {
+	var c Config
+	err := json.Unmarshal([]byte(`{"deployPath": "/tmp/x", "beforeCmd": "echo \"$WATCHER_PROJECT\" && echo  two", "afterCmd": ["echo", "a  b", "{stageDir}"]}`), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt := utils.CmdOptions{Env: []string{"WATCHER_PROJECT=a.com"}}
+	cmd := runCmd(c.BeforeCmd, opt)
+	if !cmd.Success || cmd.Out != "a.com\ntwo\n" {
+		t.Fatalf("test shell hook failed, %+v", cmd)
+	}
+	cmd = runCmd(expandStage(c.AfterCmd, "/stage", ""), opt)
+	if !cmd.Success || cmd.Out != "a  b /stage\n" {
+		t.Fatalf("test argv hook failed, %+v", cmd)
+	}
+
+	c = Config{}
+	err = json.Unmarshal([]byte(`{"deployPath": "/tmp/x", "afterCmd": "pwd; sleep 2", "cmdTimeout": "200ms", "cmdDir": "/"}`), &c)
+	if err == nil {
+		err = c.checkConfig()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd = runCmd(c.AfterCmd, c.cmdOptions(nil))
+	if cmd.Success || !cmd.TimedOut || cmd.Out != "/\n" {
+		t.Fatalf("test hook timeout failed, %+v", cmd)
+	}
+
+	// the failure is sent to the callback
+	cmd = runCmd(Hook{Shell: "echo oops >&2; exit 2"}, utils.CmdOptions{})
+	bt, err := (&Response{AfterCmd: cmd}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := Decode(string(bt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd = response.AfterCmd
+	if cmd.Success || cmd.ExitCode != 2 || cmd.Stderr != "oops\n" || len(cmd.Err) == 0 || cmd.StartedAt.IsZero() {
+		t.Fatalf("test hook result failed, %+v", cmd)
+	}
+
+	err = json.Unmarshal([]byte(`{"afterCmd": 1}`), &c)
+	if err == nil {
+		t.Fatal("test hook failed, a number is accepted")
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	OutboxMinBackoff = 10 * time.Millisecond
+	defer func() { OutboxMinBackoff = time.Second }()
+
+	// the receiver is down for the first two attempts
+	var attempts int32
+	idCh := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if _, err := utils.VerifyRequest(r, "secret-of-outbox"); err != nil {
+			t.Errorf("test outbox failed, not signed by the project, %v", err)
+		}
+		idCh <- r.Header.Get("X-Watcher-Delivery")
+	}))
+	defer ts.Close()
+
+	dir := filepath.Join(os.TempDir(), "watcher-outbox-unittest")
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	// the secret is resolved when the callback is sent
+	o, err := newOutbox(dir, time.Hour, func(proPrefix string) string { return "secret-of-" + proPrefix })
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := &Response{Action: backend.ActionSet, Code: http.StatusOK}
+	err = o.add(Sink{URL: ts.URL}, "outbox", response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Size() != 1 {
+		t.Fatalf("test outbox failed, size:%v", o.Size())
+	}
+	fi, err := os.Stat(o.file(response.DeliveryID))
+	if err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("test outbox failed, delivery file readable by others, %v", err)
+	}
+	if bt, _ := ioutil.ReadFile(o.file(response.DeliveryID)); strings.Contains(string(bt), "secret-of-") {
+		t.Fatalf("test outbox failed, secret written to the disk, %s", bt)
+	}
+
+	exitCh := make(chan bool)
+	defer close(exitCh)
+	go o.run(exitCh)
+	select {
+	case id := <-idCh:
+		if id != response.DeliveryID || len(id) == 0 {
+			t.Fatalf("test outbox failed, delivery id %v<-->%v", id, response.DeliveryID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("test outbox failed, not delivered")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if o.Size() != 0 {
+		t.Fatalf("test outbox failed, size:%v", o.Size())
+	}
+
+	// too old to be sent
+	o.maxAge = 0
+	o.add(Sink{URL: ts.URL}, "", &Response{})
+	time.Sleep(100 * time.Millisecond)
+	if o.Size() != 0 || len(idCh) != 0 {
+		t.Fatalf("test outbox failed, expired delivery sent, size:%v", o.Size())
+	}
+}
+
+func TestSignedCallback(t *testing.T) {
+	respCh := make(chan *Response, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		response, err := VerifyCallback(r, "secret")
+		if err != nil {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		respCh <- response
+	}))
+	defer ts.Close()
+
+	response := &Response{Action: backend.ActionSet, Code: http.StatusOK}
+	err := response.Callback(ts.URL)
+	if err == nil {
+		t.Fatal("test signed callback failed, unsigned callback accepted")
+	}
+	err = response.SignedCallback(ts.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret := <-respCh; ret.Action != response.Action {
+		t.Fatalf("test signed callback failed, %+v", ret)
+	}
+}
+
+func TestCallbackSinks(t *testing.T) {
+	var err error
+
+	ts, respCh := newCallbackServer()
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "watcher-sinks-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "app.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sockCh := make(chan *Response, 10)
+	go http.Serve(ln, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if response, err := Decode(string(body)); err == nil {
+			sockCh <- response
+		}
+	}))
+	defer ln.Close()
+	journal := filepath.Join(dir, "log", "deploys.jsonl")
+	w.cfg.SinkRoots = []string{dir}
+	defer func() { w.cfg.SinkRoots = nil }()
+
+	sinksPrefix := prefix + "sinks"
+	sinksConf := fmt.Sprintf(`{"deployPath": "/tmp/watcher-sinks", "callback": ["%v", {"url": "unix://%v", "policy": "once", "timeout": "2s"}, "file://%v"]}`,
+		ts.URL, sock, journal)
+	err = w.client.Update(fmt.Sprintf("%v/%v", sinksPrefix, EtcdConfigNode), []byte(sinksConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.client.Delete(sinksPrefix, true)
+
+	key := fmt.Sprintf("%v/%v/a.conf", sinksPrefix, EtcdWatchNode)
+	deploy(w, sinksPrefix, []*backend.Event{{Action: backend.ActionSet, Key: key, Value: "v1", Index: 1}})
+	deploy(w, sinksPrefix, []*backend.Event{{Action: backend.ActionSet, Key: key, Value: "v2", Index: 2}})
+
+	var httpResp, sockResp *Response
+	select {
+	case httpResp = <-respCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("test callback sinks failed, no http callback")
+	}
+	select {
+	case sockResp = <-sockCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("test callback sinks failed, no unix socket callback")
+	}
+	if httpResp.DeployID != sockResp.DeployID || httpResp.DeliveryID == sockResp.DeliveryID {
+		t.Fatalf("test callback sinks failed, not expected ids, %v/%v<-->%v/%v",
+			httpResp.DeployID, httpResp.DeliveryID, sockResp.DeployID, sockResp.DeliveryID)
+	}
+
+	content, err := ioutil.ReadFile(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("test callback sinks failed, journal has %v lines", len(lines))
+	}
+	response, err := Decode(lines[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.DeployID != httpResp.DeployID || response.MD5 != utils.GetMD5Hash("v1") {
+		t.Fatalf("test callback sinks failed, not expected journal, %+v", response)
+	}
+
+	// a sink out of the sink roots gets nothing, the others are told why
+	<-respCh
+	outside := "/tmp/watcher-sinks-outside/deploys.jsonl"
+	os.RemoveAll(filepath.Dir(outside))
+	outsideConf := fmt.Sprintf(`{"deployPath": "/tmp/watcher-sinks", "callback": ["%v", "file://%v"]}`, ts.URL, outside)
+	err = w.client.Update(fmt.Sprintf("%v/%v", sinksPrefix, EtcdConfigNode), []byte(outsideConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploy(w, sinksPrefix, []*backend.Event{{Action: backend.ActionSet, Key: key, Value: "v3", Index: 3}})
+	select {
+	case response := <-respCh:
+		if response.Code != http.StatusForbidden {
+			t.Fatalf("test callback sinks failed, not expected response, %+v", response)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("test callback sinks failed, no http callback")
+	}
+	if utils.FileExists(outside) {
+		t.Fatal("test callback sinks failed, sink out of the sink roots written")
+	}
+	if ret, _ := utils.LoadFile("/tmp/watcher-sinks/a.conf"); ret != "v2" {
+		t.Fatalf("test callback sinks failed, deployed with a refused sink, %v", ret)
+	}
+
+	// a bad sink is refused with the config
+	config := &Config{DeployPath: "/tmp"}
+	for _, cb := range []string{`"ftp://a.com/cb"`, `"file://relative/x"`, `{"url": "http://a.com", "policy": "never"}`} {
+		config.Callback = nil
+		err = json.Unmarshal([]byte(cb), &config.Callback)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = config.checkConfig(); err == nil {
+			t.Fatalf("test callback sinks failed, %v accepted", cb)
+		}
+	}
+}
+
+func TestDeployGuard(t *testing.T) {
+	var err error
+
+	ts, respCh := newCallbackServer()
+	defer ts.Close()
+
+	root := "/tmp/watcher-allowed"
+	outside := "/tmp/watcher-outside"
+	os.RemoveAll(root)
+	os.RemoveAll(outside)
+	defer os.RemoveAll(root)
+	defer os.RemoveAll(outside)
+	os.MkdirAll(filepath.Join(root, "app"), 0755)
+	os.MkdirAll(outside, 0755)
+	ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644)
+	os.Symlink(outside, filepath.Join(root, "link"))
+	os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "app", "escape.conf"))
+
+	w.cfg.AllowedRoots = []string{root}
+	defer func() { w.cfg.AllowedRoots = nil }()
+
+	guardPrefix := prefix + "guard"
+	defer w.client.Delete(guardPrefix, true)
+	tests := []struct {
+		deployPath string
+		name       string
+		code       int
+	}{
+		{outside, "a.conf", http.StatusForbidden},
+		{root + "/../watcher-outside", "a.conf", http.StatusForbidden},
+		{root + "/link", "a.conf", http.StatusForbidden},
+		{"watcher-allowed/app", "a.conf", http.StatusForbidden},
+		{root + "/app", "a\x1b.conf", http.StatusForbidden},
+		{root + "/app", "..", http.StatusForbidden},
+		{root + "/app", "escape.conf", http.StatusForbidden},
+		{root + "/app/", "a.conf", http.StatusOK},
+	}
+	for _, tt := range tests {
+		conf := fmt.Sprintf(`{"deployPath": %q, "callback": "%v"}`, tt.deployPath, ts.URL)
+		err = w.client.Update(fmt.Sprintf("%v/%v", guardPrefix, EtcdConfigNode), []byte(conf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := fmt.Sprintf("%v/%v/%v", guardPrefix, EtcdWatchNode, tt.name)
+		deploy(w, guardPrefix, []*backend.Event{{Action: backend.ActionSet, Key: key, Value: "guard"}})
+
+		select {
+		case response := <-respCh:
+			if response.Code != tt.code {
+				t.Fatalf("test deploy guard failed, %v %q: code %v<-->%v, msg:%v", tt.deployPath, tt.name, response.Code, tt.code, response.Msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("test deploy guard failed, %v %q: no callback", tt.deployPath, tt.name)
+		}
+	}
+
+	if ret, _ := ioutil.ReadFile(filepath.Join(outside, "secret")); string(ret) != "secret" {
+		t.Fatalf("test deploy guard failed, file outside of the root written, %v", string(ret))
+	}
+	if utils.FileExists(filepath.Join(outside, "a.conf")) {
+		t.Fatal("test deploy guard failed, file outside of the root created")
+	}
+	if ret, _ := ioutil.ReadFile(filepath.Join(root, "app", "a.conf")); string(ret) != "guard" {
+		t.Fatalf("test deploy guard failed, not expected data, %v<-->%v", string(ret), "guard")
+	}
+}
+
+func TestAllowHook(t *testing.T) {
+	var err error
+
+	ts, respCh := newCallbackServer()
+	defer ts.Close()
+
+	dir := "/tmp/watcher-hooks"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	flag := filepath.Join(dir, "flag")
+
+	w.cfg.Hooks = map[string][]string{
+		"touch-flag": {"touch", flag},
+		"check":      {"test", "-s", StageFileHolder},
+	}
+	defer func() { w.cfg.Hooks = nil }()
+
+	hookPrefix := prefix + "hooks"
+	defer w.client.Delete(hookPrefix, true)
+	tests := []struct {
+		hooks string
+		code  int
+	}{
+		{`"afterCmd": "touch ` + flag + `"`, http.StatusForbidden},
+		{`"afterCmd": ["touch", "` + flag + `", "-c"]`, http.StatusForbidden},
+		{`"validateCmd": "check", "afterCmd": "rm -rf /"`, http.StatusForbidden},
+		{`"validateCmd": "check", "afterCmd": "touch-flag"`, http.StatusOK},
+		{`"afterCmd": ["touch", "` + flag + `"]`, http.StatusOK},
+	}
+	for i, tt := range tests {
+		os.Remove(flag)
+		conf := fmt.Sprintf(`{"deployPath": %q, "callback": "%v", %v}`, dir, ts.URL, tt.hooks)
+		err = w.client.Update(fmt.Sprintf("%v/%v", hookPrefix, EtcdConfigNode), []byte(conf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := fmt.Sprintf("%v/%v/%d.conf", hookPrefix, EtcdWatchNode, i)
+		deploy(w, hookPrefix, []*backend.Event{{Action: backend.ActionSet, Key: key, Value: "hook"}})
+
+		select {
+		case response := <-respCh:
+			if response.Code != tt.code {
+				t.Fatalf("test allow hook failed, %v: code %v<-->%v, msg:%v", tt.hooks, response.Code, tt.code, response.Msg)
+			}
+			if tt.code == http.StatusOK {
+				if !response.AfterCmd.Success || !utils.FileExists(flag) {
+					t.Fatalf("test allow hook failed, %v: hook not run, %+v", tt.hooks, response.AfterCmd)
+				}
+				continue
+			}
+			if response.AfterCmd.Success || !strings.Contains(response.AfterCmd.Msg, "allowed hook") {
+				t.Fatalf("test allow hook failed, %v: not expected cmd, %+v", tt.hooks, response.AfterCmd)
+			}
+			if utils.FileExists(flag) || utils.FileExists(filepath.Join(dir, fmt.Sprintf("%d.conf", i))) {
+				t.Fatalf("test allow hook failed, %v: refused deploy applied", tt.hooks)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("test allow hook failed, %v: no callback", tt.hooks)
+		}
+	}
+}
+
+func TestNestedTree(t *testing.T) {
+	var err error
+
+	dir := "/tmp/watcher-tree"
+	backupDir := "/tmp/watcher-tree-backup"
+	os.RemoveAll(dir)
+	os.RemoveAll(backupDir)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll(backupDir)
+
+	treePrefix := prefix + "tree"
+	defer w.client.Delete(treePrefix, true)
+	err = w.client.Update(fmt.Sprintf("%v/%v", treePrefix, EtcdConfigNode), []byte(fmt.Sprintf(`{"deployPath": %q}`, dir)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPrefix := fmt.Sprintf("%v/%v", treePrefix, EtcdWatchNode)
+	for key, value := range map[string]string{
+		"api.conf":                  "top",
+		"conf.d/upstreams/api.conf": "upstream",
+		"conf.d/web.conf":           "web",
+		"sub/x.conf":                "x",
+	} {
+		err = w.client.Update(keyPrefix+"/"+key, []byte(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a full sync writes the whole tree
+	err = w.syncProject(treePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, value := range map[string]string{
+		"api.conf":                  "top",
+		"conf.d/upstreams/api.conf": "upstream",
+		"conf.d/web.conf":           "web",
+		"sub/x.conf":                "x",
+	} {
+		ret, _ := ioutil.ReadFile(filepath.Join(dir, file))
+		if string(ret) != value {
+			t.Fatalf("test nested tree failed, %v: not expected data, %v<-->%v", file, string(ret), value)
+		}
+	}
+
+	// the dir of the last file goes with it
+	deploy(w, treePrefix, []*backend.Event{{Action: backend.ActionDelete, Key: keyPrefix + "/sub/x.conf"}})
+	if utils.FileExists(filepath.Join(dir, "sub")) {
+		t.Fatal("test nested tree failed, empty dir left")
+	}
+
+	// a dir delete takes the subtree, to the backup dir when there is one
+	err = w.client.Update(fmt.Sprintf("%v/%v", treePrefix, EtcdConfigNode), []byte(fmt.Sprintf(`{"deployPath": %q, "backupDir": %q}`, dir, backupDir)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploy(w, treePrefix, []*backend.Event{{Action: backend.ActionDelete, Key: keyPrefix + "/conf.d", Dir: true}})
+	if utils.FileExists(filepath.Join(dir, "conf.d")) {
+		t.Fatal("test nested tree failed, dir not deleted")
+	}
+	if ret, _ := ioutil.ReadFile(filepath.Join(dir, "api.conf")); string(ret) != "top" {
+		t.Fatalf("test nested tree failed, not expected data, %v<-->%v", string(ret), "top")
+	}
+	backups, _ := filepath.Glob(filepath.Join(backupDir, "conf.d_watcherbackup_*", "upstreams", "api.conf"))
+	if len(backups) != 1 {
+		t.Fatalf("test nested tree failed, subtree not backed up, %v", backups)
+	}
+
+	// a key can't climb out of the tree
+	if rel := relPath(treePrefix, keyPrefix+"/a/../../x"); rel != "a/../../x" {
+		t.Fatalf("test nested tree failed, not expected path, %v", rel)
+	}
+	if _, err = checkFile(dir, "a/../../x"); err == nil {
+		t.Fatal("test nested tree failed, .. accepted")
+	}
+}
+
+func TestFileRules(t *testing.T) {
+	var err error
+
+	ts, respCh := newCallbackServer()
+	defer ts.Close()
+
+	dir := "/tmp/watcher-rules"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	rulesPrefix := prefix + "rules"
+	defer w.client.Delete(rulesPrefix, true)
+	conf := fmt.Sprintf(`{"deployPath": %q, "callback": "%v", "files": [
+		{"pattern": "ssl/*.key", "mode": "0600", "user": "%d", "group": "%d"},
+		{"pattern": "*.sh", "mode": "0755"}]}`, dir, ts.URL, os.Getuid(), os.Getgid())
+	err = w.client.Update(fmt.Sprintf("%v/%v", rulesPrefix, EtcdConfigNode), []byte(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyPrefix := fmt.Sprintf("%v/%v", rulesPrefix, EtcdWatchNode)
+	modes := map[string]os.FileMode{
+		"ssl/a.key":  0600,
+		"bin/run.sh": 0755,
+		"a.conf":     utils.DefaultFileMode,
+		"a.key":      utils.DefaultFileMode,
+	}
+	var evs []*backend.Event
+	for rel := range modes {
+		evs = append(evs, &backend.Event{Action: backend.ActionSet, Key: keyPrefix + "/" + rel, Value: rel})
+	}
+	deploy(w, rulesPrefix, evs)
+
+	for rel, mode := range modes {
+		fi, err := os.Stat(filepath.Join(dir, rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != mode {
+			t.Fatalf("test file rules failed, %v: mode %v<-->%v", rel, fi.Mode().Perm(), mode)
+		}
+	}
+	select {
+	case response := <-respCh:
+		owner := fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+		for _, f := range response.Files {
+			if f.Mode != fmt.Sprintf("%04o", modes[relPath(rulesPrefix, f.Key)]) || f.Owner != owner {
+				t.Fatalf("test file rules failed, not expected file, %+v", f)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("test file rules failed, no callback")
+	}
+
+	// a bad rule is refused with the config
+	for _, rule := range []string{`{"pattern": "[", "mode": "0600"}`, `{"pattern": "*", "mode": "0800"}`, `{"pattern": "*", "mode": "04755"}`} {
+		var c Config
+		err = json.Unmarshal([]byte(`{"deployPath": "/tmp", "files": [`+rule+`]}`), &c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = c.checkConfig(); err == nil {
+			t.Fatalf("test file rules failed, %v accepted", rule)
+		}
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	var err error
+
+	ts, respCh := newCallbackServer()
+	defer ts.Close()
+
+	dir := "/tmp/watcher-tmpl"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	w.globalVars = prefix + "_global/" + EtcdVarsNode
+	defer func() { w.globalVars = "" }()
+	defer w.client.Delete(prefix+"_global", true)
+	err = w.client.Update(w.globalVars, []byte(`{"port": 80, "domain": "a.com"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmplPrefix := prefix + "tmpl"
+	defer w.client.Delete(tmplPrefix, true)
+	err = w.client.Update(fmt.Sprintf("%v/%v", tmplPrefix, EtcdConfigNode), []byte(fmt.Sprintf(`{"deployPath": %q, "callback": "%v"}`, dir, ts.URL)))
+	if err == nil {
+		err = w.client.Update(fmt.Sprintf("%v/%v", tmplPrefix, EtcdVarsNode), []byte(`{"port": 8080}`))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proPrefix, ok := w.varsProject(tmplPrefix + "/" + EtcdVarsNode); !ok || proPrefix != tmplPrefix {
+		t.Fatalf("test template failed, vars of %v<-->%v", proPrefix, tmplPrefix)
+	}
+	if _, ok := w.varsProject(tmplPrefix + "/" + EtcdWatchNode + "/" + EtcdVarsNode); ok {
+		t.Fatal("test template failed, config.d file taken for vars")
+	}
+
+	keyPrefix := fmt.Sprintf("%v/%v", tmplPrefix, EtcdWatchNode)
+	tmpl := "{{ .Project }} {{ .Hostname }} {{ .Vars.domain }}:{{ .Vars.port }} {{ .CPUs }}"
+	w.client.Update(keyPrefix+"/nginx.conf.tmpl", []byte(tmpl))
+	w.client.Update(keyPrefix+"/raw.conf", []byte(tmpl))
+	err = w.syncProject(tmplPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-respCh
+
+	expected := fmt.Sprintf("tmpl %v a.com:8080 %d", hostname, runtime.NumCPU())
+	if ret, _ := ioutil.ReadFile(filepath.Join(dir, "nginx.conf")); string(ret) != expected {
+		t.Fatalf("test template failed, not expected data, %v<-->%v", string(ret), expected)
+	}
+	if ret, _ := ioutil.ReadFile(filepath.Join(dir, "raw.conf")); string(ret) != tmpl {
+		t.Fatalf("test template failed, plain file rendered, %v", string(ret))
+	}
+
+	// new vars render the templates again, only the changed ones are deployed
+	w.client.Update(fmt.Sprintf("%v/%v", tmplPrefix, EtcdVarsNode), []byte(`{"port": 8081}`))
+	err = w.renderProject(tmplPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case response := <-respCh:
+		if response.Code != http.StatusOK || response.Action != ActionRender || len(response.Files) != 1 {
+			t.Fatalf("test template failed, not expected response, %+v", response)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("test template failed, no callback")
+	}
+	if ret, _ := ioutil.ReadFile(filepath.Join(dir, "nginx.conf")); !strings.HasSuffix(string(ret), ":8081 "+strconv.Itoa(runtime.NumCPU())) {
+		t.Fatalf("test template failed, not rendered again, %v", string(ret))
+	}
+	w.renderProject(tmplPrefix)
+	select {
+	case response := <-respCh:
+		t.Fatalf("test template failed, unchanged template deployed, %+v", response)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// a missing variable fails the deploy
+	deploy(w, tmplPrefix, []*backend.Event{{Action: backend.ActionSet, Key: keyPrefix + "/bad.conf.tmpl", Value: "{{ .Vars.nope }}"}})
+	select {
+	case response := <-respCh:
+		if response.Code != http.StatusInternalServerError || utils.FileExists(filepath.Join(dir, "bad.conf")) {
+			t.Fatalf("test template failed, not expected response, %+v", response)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("test template failed, no callback")
+	}
+
+	// a rejected key refuses the batch, the vars of the template don't clear it
+	deploy(w, tmplPrefix, []*backend.Event{
+		{Action: backend.ActionSet, Key: keyPrefix + "/../../x.conf", Value: "x"},
+		{Action: backend.ActionSet, Key: keyPrefix + "/a.conf", Value: "a"},
+		{Action: backend.ActionSet, Key: keyPrefix + "/b.conf.tmpl", Value: "b"},
+	})
+	select {
+	case response := <-respCh:
+		if response.Code == http.StatusOK || len(response.Files) != 3 {
+			t.Fatalf("test template failed, not expected response, %+v", response)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("test template failed, no callback")
+	}
+	for _, name := range []string{"a.conf", "b.conf"} {
+		if utils.FileExists(filepath.Join(dir, name)) {
+			t.Fatalf("test template failed, %v deployed with a rejected key", name)
+		}
+	}
+}
+
+func TestLayers(t *testing.T) {
+	ts, respCh := newCallbackServer()
+	defer ts.Close()
+
+	dir := "/tmp/watcher-layers"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	w.root = strings.TrimSuffix(prefix, hostname+"/")
+	w.cfg.Groups = []string{"web"}
+	defer func() { w.root, w.cfg.Groups = "", nil }()
+	defer w.client.Delete(w.root+EtcdAllNode, true)
+	defer w.client.Delete(w.root+EtcdGroupsNode, true)
+
+	hostPrefix := prefix + "layers"
+	allPrefix := w.root + EtcdAllNode + "/layers"
+	groupPrefix := w.root + EtcdGroupsNode + "/web/layers"
+	defer w.client.Delete(hostPrefix, true)
+
+	// the config is shared by every host
+	err := w.client.Update(fmt.Sprintf("%v/%v", allPrefix, EtcdConfigNode), []byte(fmt.Sprintf(`{"deployPath": %q, "callback": "%v"}`, dir, ts.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []struct{ layer, name, value string }{
+		{allPrefix, "a.conf", "all"},
+		{allPrefix, "b.conf", "all"},
+		{groupPrefix, "b.conf", "web"},
+		{groupPrefix, "c.conf", "web"},
+		{hostPrefix, "c.conf", "host"},
+	}
+	for _, f := range files {
+		w.client.Update(fmt.Sprintf("%v/%v/%v", f.layer, EtcdWatchNode, f.name), []byte(f.value))
+	}
+
+	if proPrefix, ok := w.projectOf(groupPrefix + "/" + EtcdWatchNode + "/b.conf"); !ok || proPrefix != hostPrefix {
+		t.Fatalf("test layers failed, project of a group key %v<-->%v", proPrefix, hostPrefix)
+	}
+
+	// the highest layer wins
+	err = w.syncProject(hostPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-respCh
+	for name, expected := range map[string]string{"a.conf": "all", "b.conf": "web", "c.conf": "host"} {
+		if ret, _ := ioutil.ReadFile(filepath.Join(dir, name)); string(ret) != expected {
+			t.Fatalf("test layers failed, not expected data of %v, %v<-->%v", name, string(ret), expected)
+		}
+	}
+
+	// a change shadowed by a higher layer isn't deployed
+	shadowed := &backend.Event{Action: backend.ActionSet, Key: allPrefix + "/" + EtcdWatchNode + "/b.conf", Value: "all2"}
+	if evs := w.resolveLayers(hostPrefix, []*backend.Event{shadowed}); len(evs) != 0 {
+		t.Fatalf("test layers failed, shadowed change kept, %+v", evs[0])
+	}
+
+	// the host file removed, the one of the group is deployed again
+	hostKey := hostPrefix + "/" + EtcdWatchNode + "/c.conf"
+	w.client.Delete(hostKey, false)
+	deploy(w, hostPrefix, []*backend.Event{{Action: backend.ActionDelete, Key: hostKey}})
+	select {
+	case response := <-respCh:
+		if response.Code != http.StatusOK {
+			t.Fatalf("test layers failed, not expected response, %+v", response)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("test layers failed, no callback")
+	}
+	if ret, _ := ioutil.ReadFile(filepath.Join(dir, "c.conf")); string(ret) != "web" {
+		t.Fatalf("test layers failed, group file not revealed, %v", string(ret))
+	}
+
+	// removed from every layer, the file is removed
+	groupKey := groupPrefix + "/" + EtcdWatchNode + "/c.conf"
+	w.client.Delete(groupKey, false)
+	deploy(w, hostPrefix, []*backend.Event{{Action: backend.ActionDelete, Key: groupKey}})
+	<-respCh
+	if utils.FileExists(filepath.Join(dir, "c.conf")) {
+		t.Fatal("test layers failed, file removed from every layer still deployed")
+	}
+}
+
+func TestLayerEventOrder(t *testing.T) {
+	dir := "/tmp/watcher-layer-order"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	w.root = strings.TrimSuffix(prefix, hostname+"/")
+	w.cfg.Groups = []string{"web"}
+	defer func() { w.root, w.cfg.Groups = "", nil }()
+	defer w.client.Delete(w.root+EtcdGroupsNode, true)
+
+	hostPrefix := prefix + "order"
+	groupPrefix := w.root + EtcdGroupsNode + "/web/order"
+	defer w.client.Delete(hostPrefix, true)
+	err := w.client.Update(fmt.Sprintf("%v/%v", groupPrefix, EtcdConfigNode), []byte(fmt.Sprintf(`{"deployPath": %q, "callback": ""}`, dir)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the layers are watched apart, the change of the host comes last
+	// although its index is lower
+	groupKey := groupPrefix + "/" + EtcdWatchNode + "/group.conf"
+	hostKey := hostPrefix + "/" + EtcdWatchNode + "/host.conf"
+	w.client.Update(groupKey, []byte("web"))
+	w.client.Update(hostKey, []byte("host"))
+	w.queue.push(hostPrefix, &backend.Event{Action: backend.ActionSet, Key: groupKey, Value: "web", Index: 6})
+	w.queue.push(hostPrefix, &backend.Event{Action: backend.ActionSet, Key: hostKey, Value: "host", Index: 5})
+
+	for i := 0; i < 50; i++ {
+		if utils.FileExists(filepath.Join(dir, "group.conf")) && utils.FileExists(filepath.Join(dir, "host.conf")) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for name, expected := range map[string]string{"group.conf": "web", "host.conf": "host"} {
+		if ret, _ := ioutil.ReadFile(filepath.Join(dir, name)); string(ret) != expected {
+			t.Fatalf("test layer event order failed, not expected data of %v, %v<-->%v", name, string(ret), expected)
+		}
+	}
+}
+
+func TestResyncRemovesDeleted(t *testing.T) {
+	dir := "/tmp/watcher-resync"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	resyncPrefix := prefix + "resync"
+	defer w.client.Delete(resyncPrefix, true)
+	err := w.client.Update(fmt.Sprintf("%v/%v", resyncPrefix, EtcdConfigNode), []byte(fmt.Sprintf(`{"deployPath": %q, "callback": ""}`, dir)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPrefix := fmt.Sprintf("%v/%v", resyncPrefix, EtcdWatchNode)
+	w.client.Update(keyPrefix+"/a.conf", []byte("a"))
+	w.client.Update(keyPrefix+"/sub/b.conf", []byte("b"))
+	err = w.syncProject(resyncPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !utils.FileExists(filepath.Join(dir, "sub/b.conf")) {
+		t.Fatal("test resync failed, file not deployed")
+	}
+
+	// the delete event is lost, the file of another tool stays
+	w.client.Delete(keyPrefix+"/sub", true)
+	ioutil.WriteFile(filepath.Join(dir, "other.conf"), []byte("other"), 0644)
+	err = w.syncProject(resyncPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if utils.FileExists(filepath.Join(dir, "sub/b.conf")) || utils.FileExists(filepath.Join(dir, "sub")) {
+		t.Fatal("test resync failed, file of a deleted key left")
+	}
+	if !utils.FileExists(filepath.Join(dir, "a.conf")) || !utils.FileExists(filepath.Join(dir, "other.conf")) {
+		t.Fatal("test resync failed, file removed")
+	}
+	if rels := loadManifest(manifestPath(dir, resyncPrefix)); len(rels) != 1 || !rels["a.conf"] {
+		t.Fatalf("test resync failed, not expected manifest, %v", rels)
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir := "/tmp/watcher-run"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	// a watcher of its own, Run sets the prefix of the host
+	runCfg := cfg
+	runCfg.Root = filepath.Join(os.TempDir(), "watcher-run-unittest")
+	runCfg.Prefix = "/watcher"
+	os.RemoveAll(runCfg.Root)
+	defer os.RemoveAll(runCfg.Root)
+	rw := NewWatcher(runCfg)
+
+	// existing before the start, deployed by force
+	runPrefix := fmt.Sprintf("/watcher/%v/run", hostname)
+	err := rw.client.Update(fmt.Sprintf("%v/%v", runPrefix, EtcdConfigNode), []byte(fmt.Sprintf(`{"deployPath": %q, "callback": ""}`, dir)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPrefix := fmt.Sprintf("%v/%v", runPrefix, EtcdWatchNode)
+	rw.client.Update(keyPrefix+"/a.conf", []byte("a"))
+	rw.Run()
+	defer rw.Exit()
+
+	waitFile := func(name, expected string) {
+		var ret []byte
+		for i := 0; i < 50; i++ {
+			ret, _ = ioutil.ReadFile(filepath.Join(dir, name))
+			if string(ret) == expected {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("test run failed, not expected data of %v, %v<-->%v", name, string(ret), expected)
+	}
+	waitFile("a.conf", "a")
+
+	// changed after the start, deployed by the watch
+	rw.client.Update(keyPrefix+"/b.conf", []byte("b"))
+	waitFile("b.conf", "b")
+
+	// events were lost, every project is deployed again
+	os.Remove(filepath.Join(dir, "a.conf"))
+	if index := rw.syncAll(true); index == 0 {
+		t.Fatal("test run failed, the watches don't start at the index of the listing")
+	}
+	waitFile("a.conf", "a")
+
+	// a project moved in at once, its files are older than its first event
+	newDir := "/tmp/watcher-run-new"
+	os.RemoveAll(newDir)
+	defer os.RemoveAll(newDir)
+	staged := filepath.Join(runCfg.Root, ".staged")
+	os.MkdirAll(filepath.Join(staged, EtcdWatchNode), 0755)
+	ioutil.WriteFile(filepath.Join(staged, EtcdConfigNode), []byte(fmt.Sprintf(`{"deployPath": %q, "callback": ""}`, newDir)), 0644)
+	ioutil.WriteFile(filepath.Join(staged, EtcdWatchNode, "c.conf"), []byte("c"), 0644)
+	time.Sleep(10 * time.Millisecond)
+	err = os.Rename(staged, filepath.Join(runCfg.Root, "watcher", hostname, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir = newDir
+	waitFile("c.conf", "c")
+}
+
+func TestOverlay(t *testing.T) {
+	ts, respCh := newCallbackServer()
+	defer ts.Close()
+
+	dir := "/tmp/watcher-overlay"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	w.root = strings.TrimSuffix(prefix, hostname+"/")
+	w.cfg.Groups = []string{"web"}
+	defer func() { w.root, w.cfg.Groups = "", nil }()
+	defer w.client.Delete(w.root+EtcdGroupsNode, true)
+
+	hostPrefix := prefix + "overlay"
+	groupPrefix := w.root + EtcdGroupsNode + "/web/overlay"
+	defer w.client.Delete(hostPrefix, true)
+
+	// the host overrides one field of the config of the group
+	err := w.client.Update(fmt.Sprintf("%v/%v", groupPrefix, EtcdConfigNode), []byte(fmt.Sprintf(`{"deployPath": %q, "callback": "%v", "cmdTimeout": "10s", "afterCmd": "true"}`, dir, ts.URL)))
+	if err == nil {
+		err = w.client.Update(fmt.Sprintf("%v/%v", hostPrefix, EtcdConfigNode), []byte(`{"cmdTimeout": "20s", "afterCmd": null}`))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := w.loadConfig(hostPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.DeployPath != dir || conf.CmdTimeout != "20s" || len(conf.AfterCmd.Shell) > 0 || len(conf.Callback) != 1 {
+		t.Fatalf("test overlay failed, not expected config, %+v", conf)
+	}
+	w.client.Update(fmt.Sprintf("%v/%v", hostPrefix, EtcdConfigNode), []byte(`{"cmdTimeout": 20}`))
+	if _, err = w.loadConfig(hostPrefix); err == nil || !strings.Contains(err.Error(), hostPrefix) {
+		t.Fatalf("test overlay failed, bad host config, err:%v", err)
+	}
+	w.client.Delete(fmt.Sprintf("%v/%v", hostPrefix, EtcdConfigNode), false)
+
+	// the tombstone hides the file of the group on this host
+	groupKeys := groupPrefix + "/" + EtcdWatchNode
+	hostKeys := hostPrefix + "/" + EtcdWatchNode
+	w.client.Update(groupKeys+"/x.conf", []byte("web"))
+	w.client.Update(groupKeys+"/y.conf", []byte("web"))
+	w.client.Update(hostKeys+"/y.conf", []byte(Tombstone))
+	err = w.syncProject(hostPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-respCh
+	if ret, _ := ioutil.ReadFile(filepath.Join(dir, "x.conf")); string(ret) != "web" {
+		t.Fatalf("test overlay failed, not expected data, %v", string(ret))
+	}
+	if utils.FileExists(filepath.Join(dir, "y.conf")) {
+		t.Fatal("test overlay failed, file under a tombstone deployed")
+	}
+	changed := &backend.Event{Action: backend.ActionSet, Key: groupKeys + "/y.conf", Value: "web2"}
+	if evs := w.resolveLayers(hostPrefix, []*backend.Event{changed}); len(evs) != 0 {
+		t.Fatalf("test overlay failed, change under a tombstone kept, %+v", evs[0])
+	}
+
+	// a new tombstone removes the deployed file
+	w.client.Update(hostKeys+"/x.conf", []byte(Tombstone))
+	deploy(w, hostPrefix, []*backend.Event{{Action: backend.ActionSet, Key: hostKeys + "/x.conf", Value: Tombstone}})
+	<-respCh
+	if utils.FileExists(filepath.Join(dir, "x.conf")) {
+		t.Fatal("test overlay failed, file not removed by the tombstone")
+	}
+
+	// the tombstone removed, the file of the group comes back
+	w.client.Delete(hostKeys+"/x.conf", false)
+	deploy(w, hostPrefix, []*backend.Event{{Action: backend.ActionDelete, Key: hostKeys + "/x.conf"}})
+	select {
+	case response := <-respCh:
+		if response.Code != http.StatusOK {
+			t.Fatalf("test overlay failed, not expected response, %+v", response)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("test overlay failed, no callback")
+	}
+	if ret, _ := ioutil.ReadFile(filepath.Join(dir, "x.conf")); string(ret) != "web" {
+		t.Fatalf("test overlay failed, group file not revealed, %v", string(ret))
+	}
+}
+
+// newCallbackServer records every callback sent to it.
+func newCallbackServer() (*httptest.Server, chan *Response) {
+	respCh := make(chan *Response, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		response, err := Decode(string(body))
+		if err == nil {
+			respCh <- response
+		}
+	}))
+	return ts, respCh
+}
+
 func handleCallback(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -172,7 +1419,7 @@ func init() {
 	proPrefix = fmt.Sprintf("%v/%v", prefix, proName)
 	proWatchPrefix = fmt.Sprintf("%v/%v/%v", prefix, proName, EtcdWatchNode)
 	proConfPrefix = fmt.Sprintf("%v/%v/%v", prefix, proName, EtcdConfigNode)
-	w.client.Delete(prefix, &client.DeleteOptions{Recursive: true})
+	w.client.Delete(prefix, true)
 	w.client.Mkdir(prefix)
 	w.client.Mkdir(proPrefix)
 	w.client.Mkdir(proWatchPrefix)
@@ -181,9 +1428,9 @@ func init() {
 		log.Fatal(err)
 	}
 
-	opts := &client.WatcherOptions{Recursive: true}
-	go w.client.Watch(proWatchPrefix, opts, w.respProCh, w.exitChan)
-	go handleProAction(proPrefix, w, w.exitChan)
+	w.watchProject(proPrefix, 0, false)
+	// wait for the watch to be set up
+	time.Sleep(100 * time.Millisecond)
 
 	//time.Sleep(2 * time.Second)
 	//fmt.Println(prefix)
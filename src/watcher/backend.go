@@ -0,0 +1,49 @@
+package watcher
+
+import (
+	"fmt"
+
+	"backend"
+	"consul"
+	"etcd"
+	"filesystem"
+	"zookeeper"
+)
+
+// backends selected by local.backend
+const (
+	BackendEtcd       = "etcd"
+	BackendConsul     = "consul"
+	BackendZookeeper  = "zookeeper"
+	BackendFilesystem = "filesystem"
+)
+
+func newBackend(cfg Cfg) (backend.Backend, error) {
+	switch cfg.Backend {
+	case BackendEtcd, "":
+		cli, err := etcd.NewWithTLS(cfg.EtcdAPI, cfg.Endpoints, cfg.DialTimeout, cfg.Username, cfg.Password, cfg.EtcdTLS)
+		if err != nil {
+			return nil, err
+		}
+		return cli, nil
+	case BackendConsul:
+		cli, err := consul.New(cfg.Endpoints, cfg.DialTimeout, cfg.Token)
+		if err != nil {
+			return nil, err
+		}
+		return cli, nil
+	case BackendZookeeper:
+		cli, err := zookeeper.New(cfg.Endpoints, cfg.DialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return cli, nil
+	case BackendFilesystem:
+		cli, err := filesystem.New(cfg.Root)
+		if err != nil {
+			return nil, err
+		}
+		return cli, nil
+	}
+	return nil, fmt.Errorf("unknown backend %v", cfg.Backend)
+}
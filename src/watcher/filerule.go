@@ -0,0 +1,63 @@
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"utils"
+)
+
+// FileRule sets the mode and the owner of the files matching Pattern:
+//
+//	"files": [{"pattern": "ssl/*.key", "mode": "0600", "user": "nginx", "group": "nginx"},
+//	          {"pattern": "*.sh", "mode": "0755"}]
+type FileRule struct {
+	// path.Match pattern of the path under config.d, a pattern without
+	// "/" matches the file name in any dir
+	Pattern string `json:"pattern"`
+	Mode    string `json:"mode"`  // octal, like "0600"
+	User    string `json:"user"`  // name or id
+	Group   string `json:"group"` // name or id
+	mode    os.FileMode
+}
+
+func (r *FileRule) check() error {
+	if len(r.Pattern) == 0 {
+		return fmt.Errorf("files: pattern is null")
+	}
+	if _, err := path.Match(r.Pattern, ""); err != nil {
+		return fmt.Errorf("files: pattern %v is invalid, err:%v", r.Pattern, err)
+	}
+	if len(r.Mode) > 0 {
+		mode, err := strconv.ParseUint(r.Mode, 8, 32)
+		if err != nil || mode == 0 || mode > 0777 {
+			return fmt.Errorf("files: mode %v of %v is invalid", r.Mode, r.Pattern)
+		}
+		r.mode = os.FileMode(mode)
+	}
+	return nil
+}
+
+func (r *FileRule) match(rel string) bool {
+	name := rel
+	if !strings.Contains(r.Pattern, "/") {
+		name = path.Base(rel)
+	}
+	ok, _ := path.Match(r.Pattern, name)
+	return ok
+}
+
+// fileOptions returns how to write the file at rel, by the first rule
+// matching it.
+func (c *Config) fileOptions(rel string) utils.FileOptions {
+	for i := range c.Files {
+		r := &c.Files[i]
+		if r.match(rel) {
+			return utils.FileOptions{Mode: r.mode, User: r.User, Group: r.Group}
+		}
+	}
+	return utils.FileOptions{}
+}
@@ -0,0 +1,193 @@
+package watcher
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RejectError refuses a deploy which would write outside of the allowed
+// roots, its callback has the code 403.
+type RejectError struct {
+	Msg string
+}
+
+func (e *RejectError) Error() string {
+	return "deploy rejected, " + e.Msg
+}
+
+func rejectf(format string, args ...interface{}) error {
+	return &RejectError{Msg: fmt.Sprintf(format, args...)}
+}
+
+// hasControl reports whether s has a control character, which have no
+// place in a path and would garble the logs and the commands.
+func hasControl(s string) bool {
+	for _, r := range s {
+		if r < 0x20 || r == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalPath cleans an absolute path and resolves the symlinks of the
+// part of it which exists.
+func canonicalPath(path string) (string, error) {
+	if hasControl(path) {
+		return "", rejectf("path %q has control characters", path)
+	}
+	if !filepath.IsAbs(path) {
+		return "", rejectf("path %q isn't absolute", path)
+	}
+	path = filepath.Clean(path)
+	rest := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return filepath.Join(path, rest), nil
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+}
+
+// within reports whether path is root or under it, both canonical.
+func within(root, path string) bool {
+	if root == path || root == string(filepath.Separator) {
+		return true
+	}
+	return strings.HasPrefix(path, root+string(filepath.Separator))
+}
+
+// checkDeployPath returns the canonical path of a dir of the project, it
+// must be under one of the roots. No roots allow any absolute path.
+func checkDeployPath(roots []string, path string) (string, error) {
+	canonical, err := canonicalPath(path)
+	if err != nil {
+		return "", err
+	}
+	if len(roots) == 0 {
+		return canonical, nil
+	}
+	for _, root := range roots {
+		root, err = canonicalPath(root)
+		if err != nil {
+			return "", err
+		}
+		if within(root, canonical) {
+			return canonical, nil
+		}
+	}
+	return "", rejectf("%v is outside of the allowed roots", path)
+}
+
+// checkSinks returns the sinks of the project which may be used by the
+// host, the file and unix sinks must be under one of the roots. No roots
+// refuse them all, the refused ones are left out with the error.
+func checkSinks(roots []string, sinks Sinks) (Sinks, error) {
+	var (
+		allowed Sinks
+		err     error
+	)
+	for _, sink := range sinks {
+		sinkErr := checkSink(roots, sink.URL)
+		if sinkErr != nil {
+			if err == nil {
+				err = sinkErr
+			}
+			continue
+		}
+		allowed = append(allowed, sink)
+	}
+	return allowed, err
+}
+
+func checkSink(roots []string, rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "file" && u.Scheme != "unix" {
+		return nil
+	}
+	canonical, err := canonicalPath(u.Path)
+	if err != nil {
+		return err
+	}
+	for _, root := range roots {
+		root, err = canonicalPath(root)
+		if err != nil {
+			return err
+		}
+		if within(root, canonical) {
+			return nil
+		}
+	}
+	return rejectf("callback %v is outside of the sink roots", rawurl)
+}
+
+// checkFileName refuses the names of the keys which aren't a plain file
+// of the deploy path.
+func checkFileName(name string) error {
+	switch {
+	case len(name) == 0:
+		return rejectf("file name is null")
+	case name == "." || name == "..":
+		return rejectf("file name %q is a dir", name)
+	case strings.ContainsAny(name, `/\`):
+		return rejectf("file name %q has a separator", name)
+	case hasControl(name):
+		return rejectf("file name %q has control characters", name)
+	}
+	return nil
+}
+
+// checkFile returns the path of the file at rel, a slash separated path
+// under the canonical dir. The dirs on the way and the file itself may be
+// symlinks which stay in dir.
+func checkFile(dir, rel string) (string, error) {
+	for _, name := range strings.Split(rel, "/") {
+		err := checkFileName(name)
+		if err != nil {
+			return "", err
+		}
+	}
+	file := filepath.Join(dir, filepath.FromSlash(rel))
+	parent, err := canonicalPath(filepath.Dir(file))
+	if err != nil {
+		return "", err
+	}
+	if !within(dir, parent) {
+		return "", rejectf("file %v is under a symlink out of %v", file, dir)
+	}
+	fi, err := os.Lstat(file)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return file, nil
+	}
+	target, err := filepath.EvalSymlinks(file)
+	if err != nil || !within(dir, target) {
+		return "", rejectf("file %v is a symlink out of %v", file, dir)
+	}
+	return file, nil
+}
+
+// pruneDirs removes dir and its parents up to root, as long as they are
+// empty.
+func pruneDirs(root, dir string) {
+	for dir != root && within(root, dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,104 @@
+package watcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+var (
+	Shell = "/bin/sh"
+)
+
+// Hook is a command of the project config. A json string is run by
+// "/bin/sh -c" with the shell syntax, a json array is the argv of the
+// command and is run as is:
+//
+//	"afterCmd": "nginx -t && nginx -s reload"
+//	"afterCmd": ["/usr/sbin/nginx", "-s", "reload"]
+type Hook struct {
+	Shell string
+	Args  []string
+}
+
+func (h *Hook) UnmarshalJSON(b []byte) error {
+	*h = Hook{}
+	if string(b) == "null" {
+		return nil
+	}
+	if len(b) > 0 && b[0] == '[' {
+		return json.Unmarshal(b, &h.Args)
+	}
+	err := json.Unmarshal(b, &h.Shell)
+	if err != nil {
+		return fmt.Errorf("command must be a string or an array of strings")
+	}
+	return nil
+}
+
+func (h Hook) MarshalJSON() ([]byte, error) {
+	if h.Args != nil {
+		return json.Marshal(h.Args)
+	}
+	return json.Marshal(h.Shell)
+}
+
+func (h Hook) IsEmpty() bool {
+	return len(strings.TrimSpace(h.Shell)) == 0 && len(h.Args) == 0
+}
+
+func (h Hook) String() string {
+	if h.Args != nil {
+		return strings.Join(h.Args, " ")
+	}
+	return h.Shell
+}
+
+// argv returns the program and the arguments to run.
+func (h Hook) argv() (string, []string) {
+	if h.Args != nil {
+		return h.Args[0], h.Args[1:]
+	}
+	return Shell, []string{"-c", h.Shell}
+}
+
+// replace returns the hook with r applied to the command or to every
+// argument.
+func (h Hook) replace(r *strings.Replacer) Hook {
+	if h.Args == nil {
+		return Hook{Shell: r.Replace(h.Shell)}
+	}
+	args := make([]string, len(h.Args))
+	for i, arg := range h.Args {
+		args[i] = r.Replace(arg)
+	}
+	return Hook{Args: args}
+}
+
+// allowHook returns the command to run for hook when the host only allows
+// the hooks of its [hooks] section, hooks maps their names to their argv.
+// A project runs a hook by its name or by its exact argv, any other
+// command is refused. A nil hooks allows every command.
+func allowHook(hooks map[string][]string, hook Hook) (Hook, error) {
+	if hooks == nil || hook.IsEmpty() {
+		return hook, nil
+	}
+	if hook.Args == nil {
+		if args, ok := hooks[strings.TrimSpace(hook.Shell)]; ok {
+			return Hook{Args: args}, nil
+		}
+	} else {
+		for _, args := range hooks {
+			if reflect.DeepEqual(args, hook.Args) {
+				return hook, nil
+			}
+		}
+	}
+	return hook, rejectf("command %q isn't an allowed hook of the host", hook.String())
+}
+
+// refusedCmd is the result of a hook which wasn't run.
+func refusedCmd(err error) Cmd {
+	return Cmd{Err: err.Error(), Msg: err.Error(), ExitCode: -1}
+}
@@ -0,0 +1,201 @@
+package watcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"backend"
+	"utils/xlog"
+)
+
+var (
+	// projects shared by every host, and by the hosts of a group
+	EtcdAllNode    = "_all"
+	EtcdGroupsNode = "_groups"
+
+	// a config.d file with this value removes the file of the same path of
+	// the layers below it, without revealing any of them
+	Tombstone = "__watcher_tombstone__"
+)
+
+// layerRoots returns the dirs of the shared projects the host takes, from
+// the lowest precedence to the highest: _all, then the groups in the order
+// of [local] groups. The host dir comes above all of them.
+func (w *Watcher) layerRoots() []string {
+	if len(w.root) == 0 {
+		return nil
+	}
+	roots := []string{fmt.Sprintf("%v%v/", w.root, EtcdAllNode)}
+	for _, group := range w.cfg.Groups {
+		roots = append(roots, fmt.Sprintf("%v%v/%v/", w.root, EtcdGroupsNode, group))
+	}
+	return roots
+}
+
+func hasString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeConfig sets the fields of the config json over the ones of fields,
+// a null field resets it to its default.
+func mergeConfig(fields map[string]json.RawMessage, conf []byte) (map[string]json.RawMessage, error) {
+	var layer map[string]json.RawMessage
+	err := json.Unmarshal(conf, &layer)
+	if err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		fields = make(map[string]json.RawMessage)
+	}
+	for k, v := range layer {
+		fields[k] = v
+	}
+	return fields, nil
+}
+
+// layers returns the prefixes of the project in every root, the host one
+// last.
+func (w *Watcher) layers(proPrefix string) []string {
+	name := fileName(proPrefix)
+	var layers []string
+	for _, root := range w.layerRoots() {
+		layers = append(layers, root+name)
+	}
+	return append(layers, proPrefix)
+}
+
+// layerOf returns the index in layers of the layer holding key, -1 when
+// none does.
+func layerOf(layers []string, key string) int {
+	key = squashSlashes(key)
+	for i := len(layers) - 1; i >= 0; i-- {
+		if strings.HasPrefix(key, squashSlashes(layers[i]+"/")) {
+			return i
+		}
+	}
+	return -1
+}
+
+// projectOf returns the project of a key of the host dir or of a shared
+// root, a project is always named by its host prefix.
+func (w *Watcher) projectOf(key string) (string, bool) {
+	key = squashSlashes(key)
+	roots := append([]string{w.cfg.Prefix}, w.layerRoots()...)
+	for _, root := range roots {
+		root = squashSlashes(root)
+		if !strings.HasPrefix(key, root) {
+			continue
+		}
+		name := strings.SplitN(strings.TrimPrefix(key, root), "/", 2)[0]
+		if len(name) == 0 {
+			return "", false
+		}
+		return w.cfg.Prefix + name, true
+	}
+	return "", false
+}
+
+// layerFiles returns the files of the project at rel, a file or a dir, ""
+// for all of them. The file of the highest layer shadows the ones of the
+// same path below it, a Tombstone hides them all. The layer skip isn't
+// read.
+func (w *Watcher) layerFiles(proPrefix, rel, skip string) ([]*backend.Event, error) {
+	files := make(map[string]*backend.Event)
+	for _, layer := range w.layers(proPrefix) {
+		if layer == skip {
+			continue
+		}
+		dir := fmt.Sprintf("%s/%s", layer, EtcdWatchNode)
+		if len(rel) > 0 {
+			dir = dir + "/" + rel
+			value, err := w.client.Read(dir)
+			if err != nil {
+				return nil, err
+			}
+			if value != nil {
+				files[rel] = &backend.Event{Action: ActionSync, Key: dir, Value: string(value)}
+				continue
+			}
+		}
+		evs, err := w.syncEvents(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, ev := range evs {
+			files[relPath(proPrefix, ev.Key)] = ev
+		}
+	}
+
+	rels := make([]string, 0, len(files))
+	for rel, ev := range files {
+		if ev.Value != Tombstone {
+			rels = append(rels, rel)
+		}
+	}
+	sort.Strings(rels)
+	evs := make([]*backend.Event, 0, len(rels))
+	for _, rel := range rels {
+		evs = append(evs, files[rel])
+	}
+	return evs, nil
+}
+
+// shadowed reports whether one of layers has the file at rel.
+func (w *Watcher) shadowed(layers []string, rel string) bool {
+	for _, layer := range layers {
+		value, err := w.client.Read(fmt.Sprintf("%s/%s/%s", layer, EtcdWatchNode, rel))
+		if err == nil && value != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveLayers turns the events of the layers of the project into the
+// changes of its files: a change shadowed by a higher layer is dropped, a
+// Tombstone removes the file and a delete reveals the files of the other
+// layers at the same path.
+func (w *Watcher) resolveLayers(proPrefix string, evs []*backend.Event) []*backend.Event {
+	layers := w.layers(proPrefix)
+	var res []*backend.Event
+	for _, ev := range evs {
+		level := layerOf(layers, ev.Key)
+		rel := relPath(proPrefix, ev.Key)
+		if ev.Action == ActionSync || ev.Action == ActionRender || level < 0 || len(rel) == 0 {
+			res = append(res, ev)
+			continue
+		}
+		if !ev.Dir && w.shadowed(layers[level+1:], rel) {
+			xlog.Debug("resolveLayers: %v is shadowed, action:%v", ev.Key, ev.Action)
+			continue
+		}
+		if ev.Action != backend.ActionDelete && ev.Value == Tombstone {
+			xlog.Debug("resolveLayers: %v is a tombstone, remove the file", ev.Key)
+			res = append(res, &backend.Event{Action: backend.ActionDelete, Key: ev.Key, Index: ev.Index})
+			continue
+		}
+		res = append(res, ev)
+		if ev.Action != backend.ActionDelete {
+			continue
+		}
+		revealed, err := w.layerFiles(proPrefix, rel, layers[level])
+		if err != nil {
+			xlog.Warn("resolveLayers: layerFiles is err, project:%v, rel:%v, err:%v", proPrefix, rel, err)
+			continue
+		}
+		if !ev.Dir && len(revealed) == 1 && relPath(proPrefix, revealed[0].Key) == rel {
+			// the file is replaced rather than removed
+			res[len(res)-1] = revealed[0]
+			continue
+		}
+		res = append(res, revealed...)
+	}
+	return res
+}
@@ -0,0 +1,113 @@
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"backend"
+	"utils"
+	"utils/xlog"
+)
+
+// the files deployed by a project are listed in a manifest kept in its
+// deployPath, a resync removes the ones whose keys were deleted while the
+// events were lost. The other files of deployPath are never touched.
+var ManifestPrefix = ".watcher-"
+
+func manifestPath(deployPath, proPrefix string) string {
+	return filepath.Join(deployPath, ManifestPrefix+fileName(proPrefix)+".files")
+}
+
+// loadManifest returns the slash separated paths under deployPath listed
+// in the manifest, a missing manifest lists none.
+func loadManifest(path string) map[string]bool {
+	rels := make(map[string]bool)
+	content, err := utils.LoadFile(path)
+	if err != nil {
+		return rels
+	}
+	for _, rel := range strings.Split(content, "\n") {
+		if len(rel) > 0 {
+			rels[rel] = true
+		}
+	}
+	return rels
+}
+
+func saveManifest(path string, rels map[string]bool) error {
+	if len(rels) == 0 {
+		err := os.Remove(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	list := make([]string, 0, len(rels))
+	for rel := range rels {
+		list = append(list, rel)
+	}
+	sort.Strings(list)
+	content := strings.Join(list, "\n") + "\n"
+	return utils.FileWrite(path, &content)
+}
+
+// updateManifest records the files of a deploy which were applied, a
+// deleted dir takes the files under it.
+func updateManifest(rels map[string]bool, deployPath string, files []File) {
+	for _, f := range files {
+		if len(f.Msg) > 0 || len(f.Path) == 0 {
+			continue
+		}
+		rel, err := filepath.Rel(deployPath, f.Path)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		if f.Action != backend.ActionDelete {
+			rels[rel] = true
+			continue
+		}
+		for r := range rels {
+			if r == rel || strings.HasPrefix(r, rel+"/") {
+				delete(rels, r)
+			}
+		}
+	}
+}
+
+// orphans returns a delete event for every file of the manifest of the
+// project which isn't one of the listed files.
+func (w *Watcher) orphans(proPrefix string, config *Config, listed []*backend.Event) []*backend.Event {
+	deployPath, err := checkDeployPath(w.cfg.AllowedRoots, config.DeployPath)
+	if err != nil {
+		// refused by the deploy
+		return nil
+	}
+	keep := make(map[string]bool)
+	for _, ev := range listed {
+		rel := relPath(proPrefix, ev.Key)
+		if isTemplate(config, rel) {
+			rel = strings.TrimSuffix(rel, TemplateSuffix)
+		}
+		keep[rel] = true
+	}
+	var rels []string
+	for rel := range loadManifest(manifestPath(deployPath, proPrefix)) {
+		if !keep[rel] {
+			rels = append(rels, rel)
+		}
+	}
+	sort.Strings(rels)
+	var evs []*backend.Event
+	for _, rel := range rels {
+		xlog.Debug("orphans: project:%v, %v has no key anymore", proPrefix, rel)
+		evs = append(evs, &backend.Event{
+			Action: backend.ActionDelete,
+			Key:    fmt.Sprintf("%s/%s/%s", proPrefix, EtcdWatchNode, rel),
+		})
+	}
+	return evs
+}
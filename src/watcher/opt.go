@@ -4,21 +4,47 @@ import (
 	"flag"
 	"fmt"
 
+	"etcd"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
+	"utils"
 	"utils/conf"
 )
 
 var (
 	Prefix string
+
+	DefaultOutbox       = "/var/lib/watcher/outbox"
+	DefaultOutboxMaxAge = 24 * 3600 // seconds
 )
 
 type Cfg struct {
+	Backend     string
+	EtcdAPI     string
+	EtcdTLS     etcd.TLSConfig
 	Endpoints   string
 	DialTimeout time.Duration
 	Hostname    string
 	Username    string
 	Password    string
+	Token       string
+	Root        string
+	Concurrency int
+	// the deploy paths of the projects must be under one of them
+	AllowedRoots []string
+	// the only commands the projects may run, by name, nil allows any
+	Hooks map[string][]string
+	// groups of the host, the projects of a later group override the
+	// ones of an earlier one
+	Groups []string
+
+	// the file and unix sinks of the projects must be under one of them
+	SinkRoots    []string
+	Outbox       string // dir of the callbacks not delivered yet
+	OutboxMaxAge time.Duration
+	Secret       string // signs the callbacks and the heartbeats
 
 	Heartbeat         string
 	HeartbeatInterval time.Duration
@@ -39,15 +65,99 @@ func NewCfg(version string) Cfg {
 	localForce, err := conf.Bool("local", "force")
 	checkArg("local.force", localForce, err)
 
+	// projects deployed at the same time
+	localConcurrency, err := conf.Int("local", "concurrency")
+	if err != nil || localConcurrency <= 0 {
+		localConcurrency = DefaultConcurrency
+	}
+
+	localSecret, err := conf.Get("local", "secret")
+	//checkArg("local.secret", localSecret, err)
+
+	allowedRoots, _ := conf.Get("local", "allowed_roots")
+	localAllowedRoots := parseRoots("local.allowed_roots", allowedRoots)
+
+	var localGroups []string
+	groups, _ := conf.Get("local", "groups")
+	for _, group := range strings.Split(groups, ",") {
+		group = strings.TrimSpace(group)
+		if len(group) == 0 {
+			continue
+		}
+		if strings.Contains(group, "/") {
+			panic(fmt.Errorf("Cfg: local.groups %v has a separator", group))
+		}
+		localGroups = append(localGroups, group)
+	}
+
+	// hooks
+	var hooks map[string][]string
+	if sect, err := conf.GetSect("hooks"); err == nil {
+		hooks = make(map[string][]string)
+		for name, command := range sect {
+			args := strings.Fields(command)
+			if len(args) == 0 {
+				panic(fmt.Errorf("Cfg: hooks.%v arg is null", name))
+			}
+			hooks[name] = args
+		}
+	}
+
+	localBackend, err := conf.Get("local", "backend")
+	if err != nil || len(localBackend) == 0 {
+		localBackend = BackendEtcd
+	}
+
+	// endpoints and timeout of the backend are read from its own section
+	var (
+		endpoints string
+		timeout   int
+		fsRoot    string
+	)
+	if localBackend == BackendFilesystem {
+		fsRoot, err = conf.Get("filesystem", "root")
+		checkArg("filesystem.root", fsRoot, err)
+	} else {
+		endpoints, err = conf.Get(localBackend, "endpoints")
+		checkArg(localBackend+".endpoints", endpoints, err)
+		timeout, err = conf.Int(localBackend, "timeout")
+		checkArg(localBackend+".timeout", timeout, err)
+	}
+
 	// etcd
-	etcdEndpoints, err := conf.Get("etcd", "endpoints")
-	checkArg("etcd.endpoints", etcdEndpoints, err)
-	etcdTimeout, err := conf.Int("etcd", "timeout")
-	checkArg("etcd.timeout", etcdTimeout, err)
+	etcdAPI, err := conf.Get("etcd", "api")
+	if err != nil {
+		etcdAPI = etcd.APIv2
+	}
 	etcdUsername, err := conf.Get("etcd", "username")
 	//checkArg("etcd.username", etcdUsername, err)
 	etcdPassword, err := conf.Get("etcd", "password")
 	//checkArg("etcd.password", etcdPassword, err)
+	etcdCAFile, _ := conf.Get("etcd", "ca_file")
+	etcdCertFile, _ := conf.Get("etcd", "cert_file")
+	etcdKeyFile, _ := conf.Get("etcd", "key_file")
+	etcdServerName, _ := conf.Get("etcd", "server_name")
+	etcdRequireTLS, _ := conf.Bool("etcd", "require_tls")
+
+	// consul
+	consulToken, err := conf.Get("consul", "token")
+	//checkArg("consul.token", consulToken, err)
+
+	// callback
+	outbox, err := conf.Get("callback", "outbox")
+	if err != nil || len(outbox) == 0 {
+		outbox = DefaultOutbox
+	}
+	// the pending callbacks are found again whatever the working dir
+	if !filepath.IsAbs(outbox) {
+		panic(fmt.Errorf("Cfg: callback.outbox %v isn't an absolute path", outbox))
+	}
+	sinkRoots, _ := conf.Get("callback", "sink_roots")
+	callbackSinkRoots := parseRoots("callback.sink_roots", sinkRoots)
+	outboxMaxAge, err := conf.Int("callback", "max_age")
+	if err != nil || outboxMaxAge <= 0 {
+		outboxMaxAge = DefaultOutboxMaxAge
+	}
 
 	// heartbeat
 	heartbeatDomain, err := conf.Get("heartbeat", "domain")
@@ -56,11 +166,30 @@ func NewCfg(version string) Cfg {
 	checkArg("heartbeat.interval", heartbeatInterval, err)
 
 	return Cfg{
-		Endpoints:         etcdEndpoints,
-		DialTimeout:       time.Duration(etcdTimeout) * time.Second,
+		Backend: localBackend,
+		EtcdAPI: etcdAPI,
+		EtcdTLS: etcd.TLSConfig{
+			CAFile:     etcdCAFile,
+			CertFile:   etcdCertFile,
+			KeyFile:    etcdKeyFile,
+			ServerName: etcdServerName,
+			RequireTLS: etcdRequireTLS,
+		},
+		Endpoints:         endpoints,
+		DialTimeout:       time.Duration(timeout) * time.Second,
 		Hostname:          hostname,
 		Username:          etcdUsername,
 		Password:          etcdPassword,
+		Token:             consulToken,
+		Root:              fsRoot,
+		Concurrency:       localConcurrency,
+		AllowedRoots:      localAllowedRoots,
+		Hooks:             hooks,
+		Groups:            localGroups,
+		SinkRoots:         callbackSinkRoots,
+		Outbox:            outbox,
+		OutboxMaxAge:      time.Duration(outboxMaxAge) * time.Second,
+		Secret:            localSecret,
 		Heartbeat:         heartbeatDomain,
 		HeartbeatInterval: time.Duration(heartbeatInterval) * time.Second,
 		Prefix:            localPrefix,
@@ -99,18 +228,106 @@ func (cfg *Cfg) checkCfg() (err error) {
 type Config struct {
 	DeployPath string `json:"deployPath"`
 	BackupDir  string `json:"backupDir"`
-	BeforeCmd  string `json:"beforeCmd"`
-	AfterCmd   string `json:"afterCmd"`
-	Callback   string `json:"callback"`
+	BeforeCmd  Hook   `json:"beforeCmd"`
+	AfterCmd   Hook   `json:"afterCmd"`
+	Callback   Sinks  `json:"callback"`
+
+	// events coming within BatchWindow of each other are deployed
+	// together, like "2s"
+	BatchWindow string `json:"batchWindow"`
+	batchWindow time.Duration
+
+	// checks the files staged in a temporary dir before they are deployed,
+	// {stageDir} and {stageFile} are replaced by their paths
+	ValidateCmd Hook `json:"validateCmd"`
+
+	// the files are restored when the deploy fails
+	RollbackOnFailure bool `json:"rollbackOnFailure"`
+
+	// the commands are run in CmdDir as RunAs, "user" or "user:group",
+	// and killed after CmdTimeout, ExecCmdTimeout by default
+	CmdTimeout string `json:"cmdTimeout"`
+	CmdDir     string `json:"cmdDir"`
+	RunAs      string `json:"runAs"`
+	cmdTimeout time.Duration
+
+	// signs the callbacks of the project instead of [local] secret
+	Secret string `json:"secret"`
+
+	// the mode and the owner of the files, by the first rule matching
+	// them, see FileRule
+	Files []FileRule `json:"files"`
+
+	// every file is a text/template, not only the ones ending with
+	// TemplateSuffix
+	Template bool `json:"template"`
 }
 
 func (c *Config) checkConfig() (err error) {
 	if len(c.DeployPath) == 0 {
 		return fmt.Errorf("DeployPath argument is null")
 	}
+	if len(c.BatchWindow) > 0 {
+		c.batchWindow, err = time.ParseDuration(c.BatchWindow)
+		if err != nil || c.batchWindow < 0 {
+			return fmt.Errorf("BatchWindow argument %v is invalid", c.BatchWindow)
+		}
+	}
+	for i := range c.Callback {
+		err = c.Callback[i].check()
+		if err != nil {
+			return
+		}
+	}
+	for i := range c.Files {
+		err = c.Files[i].check()
+		if err != nil {
+			return
+		}
+	}
+	c.cmdTimeout = ExecCmdTimeout
+	if len(c.CmdTimeout) > 0 {
+		c.cmdTimeout, err = time.ParseDuration(c.CmdTimeout)
+		if err != nil || c.cmdTimeout <= 0 {
+			return fmt.Errorf("CmdTimeout argument %v is invalid", c.CmdTimeout)
+		}
+	}
 	return
 }
 
+// cmdOptions returns the options running the commands of the project.
+func (c *Config) cmdOptions(env []string) utils.CmdOptions {
+	opt := utils.CmdOptions{
+		Timeout: c.cmdTimeout,
+		Env:     env,
+		Dir:     c.CmdDir,
+	}
+	if opt.Timeout <= 0 {
+		opt.Timeout = ExecCmdTimeout
+	}
+	opt.User, opt.Group = c.RunAs, ""
+	if i := strings.Index(c.RunAs, ":"); i >= 0 {
+		opt.User, opt.Group = c.RunAs[:i], c.RunAs[i+1:]
+	}
+	return opt
+}
+
+// parseRoots reads a comma separated list of absolute dirs.
+func parseRoots(name, value string) []string {
+	var roots []string
+	for _, root := range strings.Split(value, ",") {
+		root = strings.TrimSpace(root)
+		if len(root) == 0 {
+			continue
+		}
+		if !filepath.IsAbs(root) {
+			panic(fmt.Errorf("Cfg: %v %v isn't an absolute path", name, root))
+		}
+		roots = append(roots, root)
+	}
+	return roots
+}
+
 func init() {
 	flag.StringVar(&Prefix, "prefix", "", "key path prefix")
 }
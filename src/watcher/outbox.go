@@ -0,0 +1,224 @@
+package watcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"utils"
+	"utils/xlog"
+)
+
+var (
+	OutboxMinBackoff = time.Second
+	OutboxMaxBackoff = 10 * time.Minute
+	// the outbox is scanned at least that often
+	OutboxInterval = time.Minute
+)
+
+// delivery is a callback waiting in the outbox.
+type delivery struct {
+	ID        string          `json:"id"`
+	URL       string          `json:"url"`
+	Body      json.RawMessage `json:"body"`
+	Project   string          `json:"project"` // signed by its secret at the time, never stored
+	Timeout   time.Duration   `json:"timeout,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Attempts  int             `json:"attempts"`
+	NextAt    time.Time       `json:"nextAt"`
+}
+
+// outbox keeps every callback in a file of dir until it is delivered or
+// older than maxAge, so that the results survive a receiver down and a
+// restart of watcher.
+type outbox struct {
+	dir    string
+	maxAge time.Duration
+	secret func(proPrefix string) string // of the callbacks of the project
+	wake   chan struct{}
+}
+
+func newOutbox(dir string, maxAge time.Duration, secret func(string) string) (*outbox, error) {
+	// the deliveries hold the results of the deploys
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &outbox{
+		dir:    dir,
+		maxAge: maxAge,
+		secret: secret,
+		wake:   make(chan struct{}, 1),
+	}, nil
+}
+
+// newID returns a unique id which sorts by time.
+func newID() string {
+	return fmt.Sprintf("%d-%016x", time.Now().UnixNano(), rand.Int63())
+}
+
+// add stores the response of the project for the sink, it is sent by run.
+func (o *outbox) add(s Sink, proPrefix string, r *Response) error {
+	if len(r.DeliveryID) == 0 {
+		r.DeliveryID = newID()
+	}
+	body, err := r.Encode()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	d := &delivery{
+		ID:        r.DeliveryID,
+		URL:       s.URL,
+		Body:      body,
+		Project:   proPrefix,
+		Timeout:   s.timeout,
+		CreatedAt: now,
+		NextAt:    now,
+	}
+	err = o.save(d)
+	if err != nil {
+		return err
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (o *outbox) file(id string) string {
+	return filepath.Join(o.dir, id+".json")
+}
+
+func (o *outbox) save(d *delivery) error {
+	bt, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	content := string(bt)
+	return utils.FileWriteWithOptions(o.file(d.ID), &content, utils.FileOptions{Mode: 0600})
+}
+
+// ids returns the deliveries in the outbox, oldest first.
+func (o *outbox) ids() ([]string, error) {
+	infos, err := ioutil.ReadDir(o.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, fi := range infos {
+		name := fi.Name()
+		// skip the temporary files of utils.FileWrite
+		if strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(name, ".json"))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Size returns the number of callbacks not delivered yet.
+func (o *outbox) Size() int {
+	ids, err := o.ids()
+	if err != nil {
+		return 0
+	}
+	return len(ids)
+}
+
+// outboxBackoff doubles the wait of every attempt, with a random half of it
+// as jitter.
+func outboxBackoff(attempts int) time.Duration {
+	d := OutboxMinBackoff
+	for i := 1; i < attempts && d < OutboxMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > OutboxMaxBackoff {
+		d = OutboxMaxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// flush tries the deliveries which are due and returns when the next one
+// is.
+func (o *outbox) flush() time.Time {
+	next := time.Now().Add(OutboxInterval)
+	ids, err := o.ids()
+	if err != nil {
+		xlog.Warn("outbox: read dir %v is err, err:%v", o.dir, err)
+		return next
+	}
+
+	for _, id := range ids {
+		file := o.file(id)
+		bt, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		d := &delivery{}
+		err = json.Unmarshal(bt, d)
+		if err != nil {
+			xlog.Warn("outbox: drop broken delivery %v, err:%v", file, err)
+			os.Remove(file)
+			continue
+		}
+
+		now := time.Now()
+		if now.Sub(d.CreatedAt) > o.maxAge {
+			xlog.Warn("outbox: drop delivery %v to %v after %v attempts, older than %v", d.ID, d.URL, d.Attempts, o.maxAge)
+			os.Remove(file)
+			continue
+		}
+		if now.Before(d.NextAt) {
+			if d.NextAt.Before(next) {
+				next = d.NextAt
+			}
+			continue
+		}
+
+		err = deliver(d.URL, d.Body, d.ID, o.secret(d.Project), d.Timeout)
+		if err == nil {
+			xlog.Debug("outbox: delivery %v to %v OK", d.ID, d.URL)
+			os.Remove(file)
+			continue
+		}
+		d.Attempts++
+		d.NextAt = now.Add(outboxBackoff(d.Attempts))
+		xlog.Warn("outbox: delivery %v to %v is err, attempts:%v, retry at %v, err:%v", d.ID, d.URL, d.Attempts, d.NextAt.Format(TimeFormat), err)
+		err = o.save(d)
+		if err != nil {
+			xlog.Warn("outbox: save delivery %v is err, err:%v", d.ID, err)
+		}
+		if d.NextAt.Before(next) {
+			next = d.NextAt
+		}
+	}
+	return next
+}
+
+// run delivers the callbacks until exitCh is closed, the ones left by
+// the last run of watcher go first.
+func (o *outbox) run(exitCh chan bool) {
+	xlog.Debug("outbox goroutine running")
+	for {
+		next := o.flush()
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-o.wake:
+			timer.Stop()
+		case <-exitCh:
+			timer.Stop()
+			xlog.Debug("outbox goroutine ending")
+			return
+		}
+	}
+}
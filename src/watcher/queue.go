@@ -0,0 +1,243 @@
+package watcher
+
+import (
+	"sync"
+	"time"
+
+	"backend"
+	"utils/xlog"
+)
+
+var (
+	DefaultConcurrency = 4
+	// a batch is deployed at the latest after that many windows, even
+	// when the changes keep coming
+	BatchMaxWindows = 10
+)
+
+// deployQueue applies the events of a project one after the other, in the
+// order of their index, so that the last write wins on disk and the
+// commands of a project never overlap. Different projects are deployed
+// concurrently, at most limit of them at a time.
+type deployQueue struct {
+	sync.Mutex
+	w        *Watcher
+	sem      chan struct{}
+	projects map[string]*projectQueue
+}
+
+type projectQueue struct {
+	proPrefix string
+	events    []*backend.Event
+	// index of the last applied event of every layer, the layers are
+	// watched apart and their events may come out of index order
+	lastIndex map[string]uint64
+	running   bool
+	pushed    chan struct{} // signaled on every push
+}
+
+func newDeployQueue(w *Watcher, limit int) *deployQueue {
+	if limit <= 0 {
+		limit = DefaultConcurrency
+	}
+	return &deployQueue{
+		w:        w,
+		sem:      make(chan struct{}, limit),
+		projects: make(map[string]*projectQueue),
+	}
+}
+
+// push queues ev for the project, a worker is started when the project
+// has none.
+func (q *deployQueue) push(proPrefix string, ev *backend.Event) {
+	q.Lock()
+	defer q.Unlock()
+	p, ok := q.projects[proPrefix]
+	if !ok {
+		p = &projectQueue{proPrefix: proPrefix, lastIndex: make(map[string]uint64), pushed: make(chan struct{}, 1)}
+		q.projects[proPrefix] = p
+	}
+	p.events = append(p.events, ev)
+	select {
+	case p.pushed <- struct{}{}:
+	default:
+	}
+	if !p.running {
+		p.running = true
+		go q.run(p)
+	}
+}
+
+// Depth returns the number of events waiting to be applied.
+func (q *deployQueue) Depth() int {
+	q.Lock()
+	defer q.Unlock()
+	depth := 0
+	for _, p := range q.projects {
+		depth += len(p.events)
+	}
+	return depth
+}
+
+func (q *deployQueue) next(p *projectQueue) *backend.Event {
+	q.Lock()
+	defer q.Unlock()
+	if len(p.events) == 0 {
+		p.running = false
+		return nil
+	}
+	ev := p.events[0]
+	p.events[0] = nil
+	p.events = p.events[1:]
+	return ev
+}
+
+// run is the worker of a project, it ends when the queue is empty.
+func (q *deployQueue) run(p *projectQueue) {
+	for {
+		ev := q.next(p)
+		if ev == nil {
+			return
+		}
+		// a watch resumed after an error may replay old events
+		if q.stale(p, ev, p.lastIndex) {
+			continue
+		}
+
+		evs := []*backend.Event{ev}
+		if !isProjectEvent(ev) {
+			var ok bool
+			evs, ok = q.collect(p, evs)
+			if !ok {
+				return
+			}
+		}
+
+		select {
+		case q.sem <- struct{}{}:
+		case <-q.w.exitChan:
+			return
+		}
+		q.apply(p.proPrefix, evs)
+		<-q.sem
+
+		for _, ev := range evs {
+			q.advance(p, ev, p.lastIndex)
+		}
+	}
+}
+
+// layer returns the layer of the project the event comes from, "" for the
+// events of the whole project.
+func (q *deployQueue) layer(p *projectQueue, ev *backend.Event) string {
+	layers := q.w.layers(p.proPrefix)
+	i := layerOf(layers, ev.Key)
+	if i < 0 {
+		return ""
+	}
+	return layers[i]
+}
+
+func (q *deployQueue) stale(p *projectQueue, ev *backend.Event, lastIndex map[string]uint64) bool {
+	last := lastIndex[q.layer(p, ev)]
+	if ev.Index != 0 && ev.Index <= last {
+		xlog.Debug("deployQueue: drop stale event, key:%v, index:%v, last index:%v", ev.Key, ev.Index, last)
+		return true
+	}
+	return false
+}
+
+func (q *deployQueue) advance(p *projectQueue, ev *backend.Event, lastIndex map[string]uint64) {
+	layer := q.layer(p, ev)
+	if ev.Index > lastIndex[layer] {
+		lastIndex[layer] = ev.Index
+	}
+}
+
+// collect waits for the batchWindow of the project to pass without a new
+// event and adds the queued events to evs, up to the next resync. It
+// returns false when the watcher exits.
+func (q *deployQueue) collect(p *projectQueue, evs []*backend.Event) ([]*backend.Event, bool) {
+	config, err := q.w.loadConfig(p.proPrefix)
+	if err != nil || config.batchWindow <= 0 {
+		return evs, true
+	}
+	window := config.batchWindow
+
+	// the signal of the first event
+	select {
+	case <-p.pushed:
+	default:
+	}
+	deadline := time.Now().Add(time.Duration(BatchMaxWindows) * window)
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+wait:
+	for {
+		select {
+		case <-p.pushed:
+			// settle again, but not past the deadline
+			d := window
+			if left := time.Until(deadline); left < d {
+				d = left
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(d)
+		case <-timer.C:
+			break wait
+		case <-q.w.exitChan:
+			return nil, false
+		}
+	}
+
+	lastIndex := make(map[string]uint64, len(p.lastIndex))
+	for layer, index := range p.lastIndex {
+		lastIndex[layer] = index
+	}
+	for _, ev := range evs {
+		q.advance(p, ev, lastIndex)
+	}
+	q.Lock()
+	defer q.Unlock()
+	n := 0
+	for _, ev := range p.events {
+		if isProjectEvent(ev) {
+			break
+		}
+		n++
+		if q.stale(p, ev, lastIndex) {
+			continue
+		}
+		q.advance(p, ev, lastIndex)
+		evs = append(evs, ev)
+	}
+	p.events = p.events[n:]
+	xlog.Debug("deployQueue: batch of project %v, events:%v", p.proPrefix, len(evs))
+	return evs, true
+}
+
+func (q *deployQueue) apply(proPrefix string, evs []*backend.Event) {
+	if len(evs) == 1 && evs[0].Action == backend.ActionResync {
+		err := q.w.syncProject(proPrefix)
+		if err != nil {
+			xlog.Warn("deployQueue: sync project is err, project:%v, err:%v", proPrefix, err)
+		}
+		return
+	}
+	if len(evs) == 1 && isProjectEvent(evs[0]) {
+		err := q.w.renderProject(proPrefix)
+		if err != nil {
+			xlog.Warn("deployQueue: render project is err, project:%v, err:%v", proPrefix, err)
+		}
+		return
+	}
+	deploy(q.w, proPrefix, evs)
+}
+
+// isProjectEvent reports whether the event is about the whole project
+// rather than one of its files, it is applied alone.
+func isProjectEvent(ev *backend.Event) bool {
+	return ev.Action == backend.ActionResync || (ev.Action == ActionRender && ev.Dir)
+}
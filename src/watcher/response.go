@@ -4,28 +4,82 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strings"
 	"time"
+	"utils"
 )
 
 var (
 	respTimeout = 60 * time.Second
+
+	// bumped when a field changes meaning or goes away, receivers must
+	// ignore the fields they don't know
+	ResponseSchemaVersion = 2
 )
 
 type Response struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	DeliveryID    string `json:"deliveryId"`
+	DeployID      string `json:"deployId"`
+
+	Hostname   string    `json:"hostname"`
+	Project    string    `json:"project"`
+	Key        string    `json:"key"` // the key of a single file deploy
+	DeployPath string    `json:"deployPath"`
+	Index      uint64    `json:"index"` // the highest etcd index deployed
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+
 	Action    string `json:"action"`
 	Code      int    `json:"code"`
 	Msg       string `json:"msg"`
 	MD5       string `json:"md5"`
 	BeforeCmd Cmd    `json:"beforeCmd"`
 	AfterCmd  Cmd    `json:"afterCmd"`
+	Files     []File `json:"files"`
+
+	// ValidateCmd checked the staged files before the deploy
+	ValidateCmd Cmd `json:"validateCmd"`
+
+	// the files were put back after a failure, RollbackCmd is the
+	// afterCmd run again with them
+	RolledBack  bool `json:"rolledBack"`
+	RollbackCmd Cmd  `json:"rollbackCmd"`
+}
+
+// File is one file of a deploy.
+type File struct {
+	Key     string `json:"key"`
+	Action  string `json:"action"`
+	Path    string `json:"path"`
+	Index   uint64 `json:"index"` // ModifiedIndex of the key
+	MD5     string `json:"md5"`
+	PrevMD5 string `json:"prevMd5"` // the file replaced, if any
+	Size    int64  `json:"size"`
+	Msg     string `json:"msg"`
+
+	// as written, like "0600" and "101:101"
+	Mode  string `json:"mode,omitempty"`
+	Owner string `json:"owner,omitempty"`
 }
 
 type Cmd struct {
 	Success bool   `json:"success"`
-	Out     string `json:"out"`
-	Err     error  `json:"err"`
+	Out     string `json:"out"` // same as Stdout, kept for the old receivers
+	Err     string `json:"err"`
 	Msg     string `json:"msg"`
+
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+	// stdout or stderr was cut to utils.DefaultMaxOutput
+	Truncated  bool      `json:"truncated"`
+	StartedAt  time.Time `json:"startedAt"`
+	DurationMs int64     `json:"durationMs"`
+
+	// killed by cmdTimeout
+	TimedOut bool `json:"timedOut"`
+	// -1 when the command didn't exit by itself
+	ExitCode int    `json:"exitCode"`
+	Signal   string `json:"signal"`
 }
 
 func (r *Response) Encode() ([]byte, error) {
@@ -46,6 +100,12 @@ func Decode(context string) (*Response, error) {
 }
 
 func (r *Response) Callback(url string) (err error) {
+	return r.SignedCallback(url, "")
+}
+
+// SignedCallback signs the callback with secret, see utils.SignRequest. url
+// is any sink, see Sink.
+func (r *Response) SignedCallback(url, secret string) (err error) {
 	if len(url) == 0 {
 		err = fmt.Errorf("Response: callback url is null")
 		return
@@ -61,16 +121,15 @@ func (r *Response) Callback(url string) (err error) {
 		return
 	}
 
-	client := http.Client{Timeout: respTimeout}
-	body := strings.NewReader(string(jsonByte))
-	resp, err := client.Post(url, "application/json", body)
+	return deliver(url, jsonByte, r.DeliveryID, secret, respTimeout)
+}
+
+// VerifyCallback checks the signature of a callback received from watcher
+// and decodes it, for the receivers written in go.
+func VerifyCallback(r *http.Request, secret string) (*Response, error) {
+	body, err := utils.VerifyRequest(r, secret)
 	if err != nil {
-		return
-	}
-	if resp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("Response: callback to %v is err, err: %v", url, resp.Status)
-		return
+		return nil, err
 	}
-
-	return
+	return Decode(string(body))
 }
@@ -0,0 +1,102 @@
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"utils"
+	"utils/xlog"
+)
+
+// snapshot is a file as it was before a deploy.
+type snapshot struct {
+	path   string
+	exists bool
+	data   string
+	// the mode and the owner, set on the temporary file before the rename
+	opt utils.FileOptions
+}
+
+// takeSnapshots keeps the files of paths, a dir is kept as all the files
+// under it.
+func takeSnapshots(paths []string) ([]snapshot, error) {
+	var snaps []snapshot
+	for _, path := range paths {
+		snap := snapshot{path: path}
+		fi, err := os.Stat(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil && fi.IsDir() {
+			dirSnaps, err := snapshotDir(path)
+			if err != nil {
+				return nil, err
+			}
+			snaps = append(snaps, dirSnaps...)
+			continue
+		}
+		if err == nil {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			snap.exists = true
+			snap.data = string(data)
+			snap.opt.Mode = fi.Mode().Perm()
+			if uid, gid := utils.FileOwner(fi); uid >= 0 {
+				snap.opt.User, snap.opt.Group = strconv.Itoa(uid), strconv.Itoa(gid)
+			}
+		}
+		snaps = append(snaps, snap)
+	}
+	return snaps, nil
+}
+
+func snapshotDir(dir string) ([]snapshot, error) {
+	var paths []string
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return takeSnapshots(paths)
+}
+
+// restoreSnapshots puts every file back, files which didn't exist are
+// removed. It goes on after an error and returns the first one.
+func restoreSnapshots(snaps []snapshot) (err error) {
+	for i := range snaps {
+		snap := &snaps[i]
+		var restoreErr error
+		if snap.exists {
+			// the dir may have been deleted with the file
+			restoreErr = os.MkdirAll(filepath.Dir(snap.path), 0755)
+			if restoreErr == nil {
+				restoreErr = utils.FileWriteWithOptions(snap.path, &snap.data, snap.opt)
+			}
+		} else {
+			restoreErr = os.Remove(snap.path)
+			if os.IsNotExist(restoreErr) {
+				restoreErr = nil
+			}
+		}
+		if restoreErr != nil {
+			xlog.Warn("restoreSnapshots: restore %v is err, err:%v", snap.path, restoreErr)
+			if err == nil {
+				err = restoreErr
+			}
+			continue
+		}
+		xlog.Debug("restoreSnapshots: restore file %v", snap.path)
+	}
+	return
+}
@@ -0,0 +1,196 @@
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"utils"
+)
+
+const (
+	// the callback is kept in the outbox and retried until it is
+	// delivered, a single attempt when there is no outbox
+	PolicyRetry = "retry"
+	// the callback is sent once when the deploy ends, a failure is only
+	// logged
+	PolicyOnce = "once"
+)
+
+// Sink is a target of the callbacks of a project:
+//
+//	http://host/path, https://host/path    POST of the response
+//	unix:///run/app.sock                   POST of the response over the socket
+//	file:///var/log/watcher/deploys.jsonl  the response appended as a line
+type Sink struct {
+	URL     string `json:"url"`
+	Policy  string `json:"policy"`  // PolicyRetry by default
+	Timeout string `json:"timeout"` // of an attempt, respTimeout by default
+	timeout time.Duration
+}
+
+func (s *Sink) UnmarshalJSON(b []byte) error {
+	*s = Sink{}
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &s.URL)
+	}
+	type sink Sink
+	err := json.Unmarshal(b, (*sink)(s))
+	if err != nil {
+		return fmt.Errorf("callback must be an url or an object with url, policy and timeout")
+	}
+	return nil
+}
+
+func (s *Sink) check() (err error) {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return fmt.Errorf("callback %v is invalid, err:%v", s.URL, err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if len(u.Host) == 0 {
+			return fmt.Errorf("callback %v has no host", s.URL)
+		}
+	case "unix", "file":
+		if len(u.Host) > 0 || !filepath.IsAbs(u.Path) {
+			return fmt.Errorf("callback %v needs an absolute path, like %v:///path", s.URL, u.Scheme)
+		}
+	default:
+		return fmt.Errorf("callback %v has an unknown scheme", s.URL)
+	}
+
+	switch s.Policy {
+	case "":
+		s.Policy = PolicyRetry
+	case PolicyRetry, PolicyOnce:
+	default:
+		return fmt.Errorf("callback %v has an unknown policy %v", s.URL, s.Policy)
+	}
+
+	s.timeout = respTimeout
+	if len(s.Timeout) > 0 {
+		s.timeout, err = time.ParseDuration(s.Timeout)
+		if err != nil || s.timeout <= 0 {
+			return fmt.Errorf("callback %v has an invalid timeout %v", s.URL, s.Timeout)
+		}
+	}
+	return nil
+}
+
+// Sinks is the callback of the project config, a single url as before or a
+// list of urls and sinks:
+//
+//	"callback": "http://www.a.com/callback"
+//	"callback": ["http://www.a.com/callback", {"url": "unix:///run/app.sock", "policy": "once"}]
+type Sinks []Sink
+
+func (ss *Sinks) UnmarshalJSON(b []byte) error {
+	*ss = nil
+	if string(b) == "null" {
+		return nil
+	}
+	if len(b) > 0 && b[0] == '[' {
+		var sinks []Sink
+		err := json.Unmarshal(b, &sinks)
+		if err != nil {
+			return err
+		}
+		for _, s := range sinks {
+			if len(s.URL) > 0 {
+				*ss = append(*ss, s)
+			}
+		}
+		return nil
+	}
+	var s Sink
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	if len(s.URL) > 0 {
+		*ss = Sinks{s}
+	}
+	return nil
+}
+
+// deliver sends a callback to the sink at rawurl, by its scheme.
+func deliver(rawurl string, body []byte, deliveryID, secret string, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = respTimeout
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "unix":
+		// the host of the request is only for the receiver's logs
+		client := &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				DisableKeepAlives: true,
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", u.Path)
+				},
+			},
+		}
+		return post(client, "http://unix/", body, deliveryID, secret)
+	case "file":
+		return appendLine(u.Path, body)
+	}
+	return post(&http.Client{Timeout: timeout}, rawurl, body, deliveryID, secret)
+}
+
+// post sends a callback, the receiver can drop the deliveries already seen
+// by their X-Watcher-Delivery header.
+func post(client *http.Client, url string, jsonByte []byte, deliveryID, secret string) (err error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(jsonByte))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(deliveryID) > 0 {
+		req.Header.Set("X-Watcher-Delivery", deliveryID)
+	}
+	utils.SignRequest(req, secret, jsonByte)
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("Response: callback to %v is err, err: %v", url, resp.Status)
+		return
+	}
+
+	return
+}
+
+// appendLine writes the response as a line of the journal, with a single
+// write so that the lines of concurrent deploys don't mix.
+func appendLine(path string, body []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	line := make([]byte, 0, len(body)+1)
+	line = append(append(line, body...), '\n')
+	_, err = f.Write(line)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"backend"
+	"utils"
+)
+
+var (
+	// placeholders of validateCmd
+	StageDirHolder  = "{stageDir}"
+	StageFileHolder = "{stageFile}"
+)
+
+// stageFiles copies the files of deployPath to a temporary dir and
+// applies the events to it, so that validateCmd checks the project as it
+// will be after the deploy. stageFile is the staged path of the last
+// written file. The staged files get the mode and the owner of the
+// deploy, the dir stays 0700 to root until openStageDir.
+func stageFiles(config *Config, evs []*backend.Event, files []File) (stageDir, stageFile string, err error) {
+	deployPath := config.DeployPath
+	stageDir, err = ioutil.TempDir("", "watcher-stage-")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(stageDir)
+			stageDir = ""
+		}
+	}()
+
+	err = filepath.Walk(deployPath, func(path string, fi os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			if os.IsNotExist(walkErr) && path == deployPath {
+				return filepath.SkipDir
+			}
+			return walkErr
+		}
+		rel, err := filepath.Rel(deployPath, path)
+		if err != nil {
+			return err
+		}
+		file := filepath.Join(stageDir, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(file, 0755)
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		return stageCopy(path, file, fi)
+	})
+	if err != nil {
+		return
+	}
+
+	for i, ev := range evs {
+		var rel string
+		rel, err = filepath.Rel(deployPath, files[i].Path)
+		if err != nil {
+			return
+		}
+		file := filepath.Join(stageDir, rel)
+		if ev.Action == backend.ActionDelete {
+			err = os.RemoveAll(file)
+		} else {
+			err = os.MkdirAll(filepath.Dir(file), 0755)
+			if err == nil {
+				err = utils.FileWriteWithOptions(file, &ev.Value, config.fileOptions(filepath.ToSlash(rel)))
+			}
+			stageFile = file
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// openStageDir gives the filled stage dir to the user running validateCmd.
+// It's done last and without following links: the owner of the dir may
+// replace its entries, root mustn't write into it anymore.
+func openStageDir(stageDir string, opt utils.CmdOptions) error {
+	if len(opt.User) == 0 && len(opt.Group) == 0 {
+		return nil
+	}
+	uid, gid, err := utils.LookupOwner(opt.User, opt.Group)
+	if err != nil {
+		return err
+	}
+	if uid < 0 {
+		// only the group is set
+		err = os.Chmod(stageDir, 0750)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Lchown(stageDir, uid, gid)
+}
+
+// stageCopy copies the file at path with its mode, and with its owner
+// when watcher may give it away.
+func stageCopy(path, file string, fi os.FileInfo) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(file, data, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if uid, gid := utils.FileOwner(fi); uid >= 0 {
+		if err = os.Chown(file, uid, gid); err != nil && !os.IsPermission(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func expandStage(hook Hook, stageDir, stageFile string) Hook {
+	r := strings.NewReplacer(StageDirHolder, stageDir, StageFileHolder, stageFile)
+	return hook.replace(r)
+}
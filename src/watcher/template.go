@@ -0,0 +1,199 @@
+package watcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"text/template"
+
+	"backend"
+	"utils/xlog"
+)
+
+const (
+	// the files of config.d with this suffix are rendered, and written
+	// without it
+	TemplateSuffix = ".tmpl"
+
+	// the templates of the projects are rendered again
+	ActionRender = "render"
+)
+
+var (
+	// json objects of the variables of the templates, the ones of the
+	// project override the global ones
+	EtcdVarsNode   = "vars"
+	EtcdGlobalNode = "_global"
+)
+
+// templateData is the data of the templates:
+//
+//	worker_processes {{ .CPUs }};
+//	listen {{ .IP }}:{{ .Vars.port }};
+type templateData struct {
+	Hostname string
+	IP       string // the first of IPs, IPv4 first
+	IPs      []string
+	CPUs     int
+	Project  string
+	Vars     map[string]interface{}
+}
+
+// hostIPs returns the addresses of the host but the loopback and link
+// local ones, IPv4 first.
+func hostIPs() []string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		xlog.Warn("hostIPs: net.InterfaceAddrs is err, err:%v", err)
+		return nil
+	}
+	var v4, v6 []string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			v4 = append(v4, ipnet.IP.String())
+		} else {
+			v6 = append(v6, ipnet.IP.String())
+		}
+	}
+	return append(v4, v6...)
+}
+
+// isTemplate reports whether the file at rel is rendered.
+func isTemplate(config *Config, rel string) bool {
+	return config.Template || strings.HasSuffix(rel, TemplateSuffix)
+}
+
+// loadVars reads a vars node, a missing node has no variables.
+func (w *Watcher) loadVars(key string) (map[string]interface{}, error) {
+	vars := make(map[string]interface{})
+	content, err := w.client.Read(key)
+	if err != nil || content == nil {
+		return vars, err
+	}
+	err = json.Unmarshal(content, &vars)
+	if err != nil {
+		return nil, fmt.Errorf("node:%v, %v", key, err)
+	}
+	return vars, nil
+}
+
+func (w *Watcher) templateData(proPrefix string) (*templateData, error) {
+	vars := make(map[string]interface{})
+	var keys []string
+	if len(w.globalVars) > 0 {
+		keys = append(keys, w.globalVars)
+	}
+	for _, layer := range w.layers(proPrefix) {
+		keys = append(keys, fmt.Sprintf("%s/%s", layer, EtcdVarsNode))
+	}
+	for _, key := range keys {
+		layer, err := w.loadVars(key)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range layer {
+			vars[k] = v
+		}
+	}
+
+	data := &templateData{
+		Hostname: w.cfg.Hostname,
+		IPs:      hostIPs(),
+		CPUs:     runtime.NumCPU(),
+		Project:  fileName(proPrefix),
+		Vars:     vars,
+	}
+	if len(data.IPs) > 0 {
+		data.IP = data.IPs[0]
+	}
+	return data, nil
+}
+
+// render executes the template, a missing variable is an error.
+func render(name, text string, data *templateData) (string, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = t.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// renderProject renders the templates of the project again, after their
+// variables changed. Only the files which change are deployed.
+func (w *Watcher) renderProject(proPrefix string) error {
+	config, err := w.loadConfig(proPrefix)
+	if err != nil {
+		return err
+	}
+	files, err := w.layerFiles(proPrefix, "", "")
+	if err != nil {
+		return err
+	}
+	var evs []*backend.Event
+	for _, ev := range files {
+		if isTemplate(&config, relPath(proPrefix, ev.Key)) {
+			ev.Action = ActionRender
+			evs = append(evs, ev)
+		}
+	}
+	if len(evs) > 0 {
+		deploy(w, proPrefix, evs)
+	}
+	xlog.Debug("renderProject: project %v rendered, files:%v", proPrefix, len(evs))
+	return nil
+}
+
+// varsProject returns the project of a vars node, of any of its layers.
+func (w *Watcher) varsProject(key string) (string, bool) {
+	proPrefix, ok := w.projectOf(key)
+	if !ok {
+		return "", false
+	}
+	for _, layer := range w.layers(proPrefix) {
+		if squashSlashes(key) == squashSlashes(layer+"/"+EtcdVarsNode) {
+			return proPrefix, true
+		}
+	}
+	return "", false
+}
+
+// renderAll renders the templates of every project, after the global
+// variables changed.
+func (w *Watcher) renderAll() {
+	w.Lock()
+	projects := append([]string(nil), w.proKey...)
+	w.Unlock()
+	for _, proPrefix := range projects {
+		w.queue.push(proPrefix, &backend.Event{Action: ActionRender, Key: proPrefix, Dir: true})
+	}
+}
+
+// watchGlobal renders every project again when the global variables
+// change.
+func (w *Watcher) watchGlobal() {
+	evCh := make(chan *backend.Event)
+	go w.client.Watch(strings.TrimSuffix(w.globalVars, "/"+EtcdVarsNode), evCh, w.exitChan)
+	for {
+		select {
+		case ev := <-evCh:
+			if ev.Action == backend.ActionResync || squashSlashes(ev.Key) == squashSlashes(w.globalVars) {
+				xlog.Debug("watchGlobal: global vars changed, action:%v", ev.Action)
+				w.renderAll()
+			}
+		case <-w.exitChan:
+			return
+		}
+	}
+}
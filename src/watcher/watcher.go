@@ -1,14 +1,14 @@
 package watcher
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
 
-	"etcd"
+	"backend"
 	"utils/xlog"
 
 	"errors"
-	"github.com/coreos/etcd/client"
 	"heartbeat"
 	"sync"
 	"time"
@@ -17,6 +17,8 @@ import (
 var (
 	EtcdConfigNode          = "config"
 	EtcdWatchNode           = "config.d"
+	ActionSync              = "sync"
+	ActionBatch             = "batch"
 	ErrorEtcdConfigNotFound = errors.New("config doesn't fond of etcd")
 
 	TimeFormat = "2006-01-02_03:04:05"
@@ -25,27 +27,39 @@ var (
 type Watcher struct {
 	sync.RWMutex
 
-	cfg       Cfg
-	client    *etcd.EtcdClient
-	proKey    []string // project's key
-	respCh    chan *client.Response
-	respProCh chan *client.Response
-	exitChan  chan bool
+	cfg      Cfg
+	client   backend.Backend
+	proKey   []string // project's key
+	queue    *deployQueue
+	outbox   *outbox // nil sends the callbacks once, without retry
+	respCh   chan *backend.Event
+	exitChan chan bool
+
+	// key of the global variables of the templates
+	globalVars string
+	// prefix above the hosts, the shared projects are under it
+	root string
 }
 
 func NewWatcher(cfg Cfg) *Watcher {
-	cli, err := etcd.New(cfg.Endpoints, cfg.DialTimeout, cfg.Username, cfg.Password)
+	cli, err := newBackend(cfg)
 	if err != nil {
 		panic(err)
 	}
 
 	w := &Watcher{
-		cfg:       cfg,
-		client:    cli,
-		proKey:    []string{},
-		respCh:    make(chan *client.Response),
-		respProCh: make(chan *client.Response),
-		exitChan:  make(chan bool),
+		cfg:      cfg,
+		client:   cli,
+		proKey:   []string{},
+		respCh:   make(chan *backend.Event),
+		exitChan: make(chan bool),
+	}
+	w.queue = newDeployQueue(w, cfg.Concurrency)
+	if len(cfg.Outbox) > 0 {
+		w.outbox, err = newOutbox(cfg.Outbox, cfg.OutboxMaxAge, w.projectSecret)
+		if err != nil {
+			panic(err)
+		}
 	}
 	go w.handleAction()
 
@@ -62,36 +76,29 @@ func (w *Watcher) handleAction() {
 				goto exit
 			}
 
+			// the templates of the project are rendered with the new vars
+			if proPrefix, ok := w.varsProject(resp.Key); ok && resp.Action != backend.ActionResync {
+				w.queue.push(proPrefix, &backend.Event{Action: ActionRender, Key: proPrefix, Dir: true})
+			}
+
 			switch resp.Action {
-			case "get", "update":
+			case backend.ActionResync:
+				// events were lost, re-list and deploy every project
+				go w.syncAll(true)
+			case "get", backend.ActionUpdate:
 			// TODO: noting
-			case "create", "set":
+			case backend.ActionCreate, backend.ActionSet:
 				/*
 					proPrefix: project's key, like "/watcher/rsyslog"
 					proConfdPrefix: project config.d's key, like "/watcher/rsyslog/config.d"
 				*/
-				proPrefix := trimProPrefix(resp.Node.Key, w.cfg.Prefix)
-				proConfdPrefix := fmt.Sprintf("%s/%s", proPrefix, EtcdWatchNode)
-				// avoid monitoring multiple project's key
-				keyExist := false
-				w.Lock()
-				for _, key := range w.proKey {
-					if key == proPrefix {
-						keyExist = true
-					}
+				proPrefix, ok := w.projectOf(resp.Key)
+				if ok {
+					// the files may have come with the project, before
+					// resp.Index, they're deployed by a sync first
+					w.watchProject(proPrefix, resp.Index, true)
 				}
-				w.Unlock()
-				if keyExist {
-					//xlog.Debug("prefix:%v already watched", proWatchPrefix)
-					continue
-				}
-				w.proKey = append(w.proKey, proPrefix)
-				fmt.Println("pro key: ", w.proKey)
-
-				opts := &client.WatcherOptions{Recursive: true}
-				go w.client.Watch(proConfdPrefix, opts, w.respProCh, w.exitChan)
-				go handleProAction(proPrefix, w, w.exitChan)
-			case "delete":
+			case backend.ActionDelete:
 				//prefix := fmt.Sprintf("%s/%s", resp.Node.Key, EtcdWatchNode)
 				//xlog.Debug("cannel watch prefix :%v", prefix)
 				// TODO: cannel watch goroutine
@@ -106,13 +113,175 @@ exit:
 	xlog.Debug("handleAction goroutine ending")
 }
 
+// watchProject starts watching the config.d of the project after index,
+// a project is only watched once. A new project is synced first when sync
+// is set.
+func (w *Watcher) watchProject(proPrefix string, index uint64, sync bool) {
+	// avoid monitoring multiple project's key
+	w.Lock()
+	for _, key := range w.proKey {
+		if key == proPrefix {
+			w.Unlock()
+			return
+		}
+	}
+	w.proKey = append(w.proKey, proPrefix)
+	w.Unlock()
+	xlog.Debug("watchProject: project key %v", proPrefix)
+	if sync {
+		// queued before the watch starts, so it goes first
+		w.queue.push(proPrefix, &backend.Event{Action: backend.ActionResync, Key: proPrefix, Dir: true})
+	}
+
+	// every project has its own channel to keep its events in order, the
+	// config.d of all its layers send to it
+	evCh := make(chan *backend.Event)
+	for _, layer := range w.layers(proPrefix) {
+		proConfdPrefix := fmt.Sprintf("%s/%s", layer, EtcdWatchNode)
+		go w.client.WatchAfter(proConfdPrefix, index, evCh, w.exitChan)
+	}
+	go handleProAction(proPrefix, w, evCh, w.exitChan)
+}
+
+// syncAll lists every project under the host prefix and the shared roots,
+// queues their deployment when force is set and starts watching them. It
+// returns the index of the listing, the watches start after it.
+func (w *Watcher) syncAll(force bool) uint64 {
+	top := w.root
+	if len(top) == 0 {
+		top = w.cfg.Prefix
+	}
+	index, err := w.client.Index(strings.TrimSuffix(top, "/"))
+	if err != nil {
+		xlog.Warn("syncAll: read index is err, prefix:%v, err:%v", top, err)
+		return 0
+	}
+
+	var projects []string
+	for _, root := range append([]string{w.cfg.Prefix}, w.layerRoots()...) {
+		keys, err := w.client.List(strings.TrimSuffix(root, "/"))
+		if err != nil {
+			xlog.Warn("syncAll: list projects is err, prefix:%v, err:%v", root, err)
+			return index
+		}
+		for _, key := range keys {
+			proPrefix := w.cfg.Prefix + fileName(key)
+			if !hasString(projects, proPrefix) {
+				projects = append(projects, proPrefix)
+			}
+		}
+	}
+
+	for _, proPrefix := range projects {
+		if force {
+			// queued before the watch starts, so it goes first
+			w.queue.push(proPrefix, &backend.Event{Action: backend.ActionResync, Key: proPrefix, Dir: true})
+		}
+		w.watchProject(proPrefix, index, false)
+	}
+	return index
+}
+
+// syncProject writes every config.d file of the project to its deployPath
+// and removes the files it deployed whose keys are gone, they are deployed
+// together so that commands and callbacks are run once.
+func (w *Watcher) syncProject(proPrefix string) error {
+	prefix, conf, err := w.getConfig(proPrefix)
+	if err != nil {
+		return err
+	}
+	if conf == nil {
+		xlog.Debug("syncProject: config node %v doesn't exist, skip", prefix)
+		return nil
+	}
+
+	evs, err := w.layerFiles(proPrefix, "", "")
+	if err != nil {
+		return err
+	}
+	// a bad config is reported by the deploy
+	if config, err := w.loadConfig(proPrefix); err == nil {
+		evs = append(evs, w.orphans(proPrefix, &config, evs)...)
+	}
+	deploy(w, proPrefix, evs)
+	xlog.Debug("syncProject: project %v synced, files:%v", proPrefix, len(evs))
+
+	return nil
+}
+
+// syncEvents returns an event for every file under dir and its sub dirs.
+func (w *Watcher) syncEvents(dir string) ([]*backend.Event, error) {
+	keys, err := w.client.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	var evs []*backend.Event
+	for _, key := range keys {
+		value, err := w.client.Read(key)
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			// directory or removed in the meantime
+			subEvs, err := w.syncEvents(key)
+			if err != nil {
+				return nil, err
+			}
+			evs = append(evs, subEvs...)
+			continue
+		}
+		evs = append(evs, &backend.Event{
+			Action: ActionSync,
+			Key:    key,
+			Value:  string(value),
+		})
+	}
+	return evs, nil
+}
+
+// getConfig reads the config of the project, the one of every layer is
+// merged field by field over the ones below it. prefix is the node of the
+// highest layer which has one.
 func (w *Watcher) getConfig(proPrefix string) (prefix string, conf []byte, err error) {
-	prefix = fmt.Sprintf("%s/%s", proPrefix, EtcdConfigNode)
-	conf, err = w.client.Read(prefix)
+	var fields map[string]json.RawMessage
+	for _, layer := range w.layers(proPrefix) {
+		node := fmt.Sprintf("%s/%s", layer, EtcdConfigNode)
+		content, err := w.client.Read(node)
+		if err != nil {
+			return node, nil, err
+		}
+		if content == nil {
+			continue
+		}
+		fields, err = mergeConfig(fields, content)
+		if err != nil {
+			return node, nil, fmt.Errorf("node:%v, %v", node, err)
+		}
+		prefix = node
+	}
+	if fields == nil {
+		return fmt.Sprintf("%s/%s", proPrefix, EtcdConfigNode), nil, nil
+	}
+	conf, err = json.Marshal(fields)
+	return
+}
+
+// loadConfig reads and checks the config of the project.
+func (w *Watcher) loadConfig(proPrefix string) (config Config, err error) {
+	prefix, conf, err := w.getConfig(proPrefix)
 	if err != nil {
 		return
 	}
-
+	if conf == nil {
+		err = ErrorEtcdConfigNotFound
+		return
+	}
+	err = json.Unmarshal(conf, &config)
+	if err != nil {
+		err = fmt.Errorf("node:%v, %v", prefix, err)
+		return
+	}
+	err = config.checkConfig()
 	return
 }
 
@@ -131,11 +300,15 @@ func (w *Watcher) Heartbeat() {
 		select {
 		case <-timeTicker.C:
 			h := &heartbeat.Heartbeat{
-				Version:   version,
-				Hostname:  hostname,
-				Timestamp: time.Now().Unix(),
+				Version:    version,
+				Hostname:   hostname,
+				Timestamp:  time.Now().Unix(),
+				QueueDepth: w.queue.Depth(),
+			}
+			if w.outbox != nil {
+				h.OutboxSize = w.outbox.Size()
 			}
-			err := h.Callback(url)
+			err := h.SignedCallback(url, w.cfg.Secret)
 			if err != nil {
 				xlog.Warn("Heartbeat: callback is err, err:%v", err)
 				continue
@@ -149,29 +322,38 @@ exit:
 	xlog.Debug("Heartbeat goroutine ending")
 }
 
-func trimProPrefix(s, prefix string) string {
-	var str string
-	st := strings.TrimPrefix(s, prefix)
-	stArr := strings.Split(st, "/")
-	str = fmt.Sprintf("%s%s", prefix, stArr[0])
-
-	return str
-}
-
 func (w *Watcher) Run() {
 	prefix := w.cfg.Prefix
 	if !strings.HasSuffix(prefix, "/") {
 		prefix = prefix + "/"
 	}
+	w.globalVars = fmt.Sprintf("%v%v/%v", prefix, EtcdGlobalNode, EtcdVarsNode)
+	w.root = prefix
 	prefix = fmt.Sprintf("%v%v/", prefix, w.cfg.Hostname)
 	w.Lock()
 	w.cfg.Prefix = prefix
 	w.Unlock()
 
+	if len(w.cfg.AllowedRoots) == 0 {
+		xlog.Warn("INSECURE: local.allowed_roots is empty, the projects may deploy to any path of the host, like /etc or /root")
+	}
+
+	// deploy and watch the existing projects, the watches start at the
+	// index of the listing so that the changes made since aren't lost
+	index := w.syncAll(w.cfg.Force)
+
 	// watch node
-	xlog.Debug("watcher prefix %v", prefix)
-	opts := &client.WatcherOptions{Recursive: true}
-	go w.client.Watch(prefix, opts, w.respCh, w.exitChan)
+	xlog.Debug("watcher prefix %v, index %v", prefix, index)
+	go w.client.WatchAfter(prefix, index, w.respCh, w.exitChan)
+	for _, root := range w.layerRoots() {
+		go w.client.WatchAfter(strings.TrimSuffix(root, "/"), index, w.respCh, w.exitChan)
+	}
+	go w.watchGlobal()
+
+	// callbacks
+	if w.outbox != nil {
+		go w.outbox.run(w.exitChan)
+	}
 
 	// heartbeat
 	go w.Heartbeat()
@@ -181,7 +363,6 @@ func (w *Watcher) Exit() {
 	xlog.Debug("watcher ending...")
 	close(w.exitChan)
 	close(w.respCh)
-	close(w.respProCh)
 	w.client.Close()
 	xlog.Debug("watcher shutdown")
 }
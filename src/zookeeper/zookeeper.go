@@ -0,0 +1,443 @@
+package zookeeper
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"backend"
+	"github.com/samuel/go-zookeeper/zk"
+	"utils/xlog"
+)
+
+var ErrClosedZkClient = errors.New("use of closed zookeeper client")
+
+// ZkClient stores the keys as persistent znodes, a directory is a znode
+// with children and no data.
+type ZkClient struct {
+	sync.Mutex
+	conn *zk.Conn
+
+	closed bool
+}
+
+func New(addr string, timeout time.Duration) (*ZkClient, error) {
+	conn, sessCh, err := zk.Connect(strings.Split(addr, ","), timeout)
+	if err != nil {
+		return nil, err
+	}
+	// the session events must be consumed
+	go func() {
+		for ev := range sessCh {
+			xlog.Debug("zookeeper session event: %v", ev.State)
+		}
+	}()
+	return &ZkClient{conn: conn}, nil
+}
+
+func (c *ZkClient) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.conn.Close()
+	return nil
+}
+
+func (c *ZkClient) isClosed() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.closed
+}
+
+func zkPath(path string) string {
+	return "/" + strings.Trim(path, "/")
+}
+
+func joinPath(dir, name string) string {
+	return strings.TrimSuffix(dir, "/") + "/" + name
+}
+
+func parentPath(path string) string {
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return path[:i]
+}
+
+func (c *ZkClient) Mkdir(dir string) error {
+	if c.isClosed() {
+		return ErrClosedZkClient
+	}
+	dir = zkPath(dir)
+	if dir == "/" {
+		return nil
+	}
+	path := ""
+	for _, name := range strings.Split(dir[1:], "/") {
+		path = path + "/" + name
+		_, err := c.conn.Create(path, nil, 0, zk.WorldACL(zk.PermAll))
+		if err != nil && err != zk.ErrNodeExists {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *ZkClient) Create(path string, data []byte) error {
+	path = zkPath(path)
+	err := c.Mkdir(parentPath(path))
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Create(path, data, 0, zk.WorldACL(zk.PermAll))
+	if err == zk.ErrNodeExists {
+		return backend.ErrNodeExists
+	}
+	if err != nil {
+		xlog.Debug("zookeeper create node %s failed: %s", path, err)
+		return err
+	}
+	xlog.Debug("zookeeper create node %s OK", path)
+	return nil
+}
+
+func (c *ZkClient) Update(path string, data []byte) error {
+	if c.isClosed() {
+		return ErrClosedZkClient
+	}
+	path = zkPath(path)
+	_, err := c.conn.Set(path, data, -1)
+	if err == zk.ErrNoNode {
+		err = c.Create(path, data)
+		if err == backend.ErrNodeExists {
+			_, err = c.conn.Set(path, data, -1)
+		}
+	}
+	if err != nil {
+		xlog.Debug("zookeeper update node %s failed: %s", path, err)
+		return err
+	}
+	xlog.Debug("zookeeper update node %s OK", path)
+	return nil
+}
+
+func (c *ZkClient) Delete(path string, recursive bool) error {
+	if c.isClosed() {
+		return ErrClosedZkClient
+	}
+	path = zkPath(path)
+	if recursive {
+		children, _, err := c.conn.Children(path)
+		if err != nil && err != zk.ErrNoNode {
+			return err
+		}
+		for _, child := range children {
+			err = c.Delete(joinPath(path, child), true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err := c.conn.Delete(path, -1)
+	if err != nil && err != zk.ErrNoNode {
+		xlog.Debug("zookeeper delete node %s failed: %s", path, err)
+		return err
+	}
+	xlog.Debug("zookeeper delete node %s OK", path)
+	return nil
+}
+
+func (c *ZkClient) Read(path string) ([]byte, error) {
+	if c.isClosed() {
+		return nil, ErrClosedZkClient
+	}
+	xlog.Debug("zookeeper read node %s", path)
+	data, stat, err := c.conn.Get(zkPath(path))
+	if err == zk.ErrNoNode {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stat.NumChildren > 0 && len(data) == 0 {
+		return nil, nil
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	return data, nil
+}
+
+func (c *ZkClient) List(path string) ([]string, error) {
+	if c.isClosed() {
+		return nil, ErrClosedZkClient
+	}
+	xlog.Debug("zookeeper list node %s", path)
+	path = zkPath(path)
+	children, _, err := c.conn.Children(path)
+	if err == zk.ErrNoNode {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(children)
+	var files []string
+	for _, child := range children {
+		files = append(files, joinPath(path, child))
+	}
+	return files, nil
+}
+
+type node struct {
+	mzxid int64
+	value string
+	dir   bool
+}
+
+// treeWatch keeps one data and one children watch on every znode of the
+// tree, zookeeper watches fire once so they are armed again on every walk.
+type treeWatch struct {
+	conn   *zk.Conn
+	ctx    context.Context
+	fired  chan zk.Event
+	dataW  map[string]bool
+	childW map[string]bool
+	zxid   int64 // the highest zxid seen by the last walk
+}
+
+func (t *treeWatch) arm(ch <-chan zk.Event) {
+	go func() {
+		select {
+		case ev := <-ch:
+			select {
+			case t.fired <- ev:
+			case <-t.ctx.Done():
+			}
+		case <-t.ctx.Done():
+		}
+	}()
+}
+
+func (t *treeWatch) disarm(ev zk.Event) {
+	switch ev.Type {
+	case zk.EventNodeCreated, zk.EventNodeDataChanged:
+		delete(t.dataW, ev.Path)
+	case zk.EventNodeChildrenChanged:
+		delete(t.childW, ev.Path)
+	default:
+		delete(t.dataW, ev.Path)
+		delete(t.childW, ev.Path)
+	}
+}
+
+// walk reads the tree under path into nodes and arms the missing watches.
+func (t *treeWatch) walk(path string, nodes map[string]*node) error {
+	var (
+		data     []byte
+		stat     *zk.Stat
+		children []string
+		ch       <-chan zk.Event
+		err      error
+	)
+	if !t.dataW[path] {
+		data, stat, ch, err = t.conn.GetW(path)
+		if err == zk.ErrNoNode {
+			// a watch for the creation of the node
+			var exists bool
+			exists, _, ch, err = t.conn.ExistsW(path)
+			if err == nil {
+				t.dataW[path] = true
+				t.arm(ch)
+				if exists {
+					delete(t.dataW, path)
+					return t.walk(path, nodes)
+				}
+			}
+			return err
+		}
+		if err == nil {
+			t.dataW[path] = true
+			t.arm(ch)
+		}
+	} else {
+		data, stat, err = t.conn.Get(path)
+	}
+	if err == zk.ErrNoNode {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !t.childW[path] {
+		children, _, ch, err = t.conn.ChildrenW(path)
+		if err == nil {
+			t.childW[path] = true
+			t.arm(ch)
+		}
+	} else {
+		children, _, err = t.conn.Children(path)
+	}
+	if err == zk.ErrNoNode {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	nodes[path] = &node{mzxid: stat.Mzxid, value: string(data), dir: len(children) > 0}
+	if stat.Mzxid > t.zxid {
+		t.zxid = stat.Mzxid
+	}
+	if stat.Pzxid > t.zxid {
+		t.zxid = stat.Pzxid
+	}
+	for _, child := range children {
+		err = t.walk(joinPath(path, child), nodes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diff returns the events turning the old nodes into the new ones.
+func diff(old, new map[string]*node, zxid int64) []*backend.Event {
+	var evs []*backend.Event
+	for path, n := range new {
+		ev := &backend.Event{Key: path, Value: n.value, Dir: n.dir, Index: uint64(n.mzxid)}
+		if o, ok := old[path]; !ok {
+			ev.Action = backend.ActionCreate
+		} else if o.mzxid != n.mzxid {
+			ev.Action = backend.ActionSet
+		} else {
+			continue
+		}
+		evs = append(evs, ev)
+	}
+	for path, o := range old {
+		if _, ok := new[path]; !ok {
+			// the zxid of a deletion is only known as the parent's pzxid
+			evs = append(evs, &backend.Event{Action: backend.ActionDelete, Key: path, Dir: o.dir, Index: uint64(zxid)})
+		}
+	}
+	sort.Slice(evs, func(i, j int) bool {
+		if evs[i].Index != evs[j].Index {
+			return evs[i].Index < evs[j].Index
+		}
+		return evs[i].Key < evs[j].Key
+	})
+	return evs
+}
+
+// Index returns the highest zxid of the tree under path, or the one of
+// its nearest ancestor when path doesn't exist.
+func (c *ZkClient) Index(path string) (uint64, error) {
+	path = zkPath(path)
+	for {
+		zxid, err := c.zxid(path)
+		if err != zk.ErrNoNode || path == "/" {
+			return uint64(zxid), err
+		}
+		path = parentPath(path)
+	}
+}
+
+func (c *ZkClient) zxid(path string) (int64, error) {
+	children, stat, err := c.conn.Children(path)
+	if err != nil {
+		return 0, err
+	}
+	zxid := stat.Mzxid
+	if stat.Pzxid > zxid {
+		zxid = stat.Pzxid
+	}
+	for _, child := range children {
+		z, err := c.zxid(joinPath(path, child))
+		if err != nil && err != zk.ErrNoNode {
+			return 0, err
+		}
+		if z > zxid {
+			zxid = z
+		}
+	}
+	return zxid, nil
+}
+
+// Watch walks the tree under path on every fired zookeeper watch and
+// sends the difference with the previous walk as events.
+func (c *ZkClient) Watch(path string, evCh chan *backend.Event, exitCh chan bool) {
+	c.WatchAfter(path, 0, evCh, exitCh)
+}
+
+// WatchAfter is Watch sending a backend.ActionResync event first when the
+// tree changed after the zxid afterIndex, the changes aren't replayed.
+func (c *ZkClient) WatchAfter(path string, afterIndex uint64, evCh chan *backend.Event, exitCh chan bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t := &treeWatch{
+		conn:   c.conn,
+		ctx:    ctx,
+		fired:  make(chan zk.Event),
+		dataW:  make(map[string]bool),
+		childW: make(map[string]bool),
+	}
+	path = zkPath(path)
+
+	var (
+		nodes   map[string]*node
+		backoff time.Duration
+	)
+	for {
+		newNodes := make(map[string]*node)
+		err := t.walk(path, newNodes)
+		if err != nil {
+			if err == zk.ErrClosing || c.isClosed() {
+				return
+			}
+			backoff = backend.NextBackoff(backoff)
+			xlog.Warn("zookeeper watch %s failed, retry after %v: %v", path, backoff, err)
+			select {
+			case <-time.After(backoff):
+				continue
+			case <-exitCh:
+				return
+			}
+		}
+		backoff = 0
+
+		var evs []*backend.Event
+		if nodes != nil {
+			evs = diff(nodes, newNodes, t.zxid)
+		} else if afterIndex > 0 && uint64(t.zxid) > afterIndex {
+			evs = []*backend.Event{{Action: backend.ActionResync, Key: path, Dir: true, Index: uint64(t.zxid)}}
+		}
+		for _, ev := range evs {
+			select {
+			case evCh <- ev:
+			case <-exitCh:
+				return
+			}
+		}
+		nodes = newNodes
+
+		select {
+		case ev := <-t.fired:
+			if ev.Type == zk.EventNotWatching && ev.Err == zk.ErrClosing {
+				return
+			}
+			t.disarm(ev)
+		case <-exitCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package zookeeper
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"backend"
+)
+
+// newTestClient skips the test when no zookeeper listens on 127.0.0.1:2181.
+func newTestClient(t *testing.T) *ZkClient {
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:2181", time.Second)
+	if err != nil {
+		t.Skipf("no zookeeper on 127.0.0.1:2181, %v", err)
+	}
+	conn.Close()
+	c, err := New("127.0.0.1:2181", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func Test_diff(t *testing.T) {
+	old := map[string]*node{
+		"/dir":   {mzxid: 1, dir: true},
+		"/dir/a": {mzxid: 2, value: "a"},
+		"/dir/b": {mzxid: 3, value: "b"},
+	}
+	new := map[string]*node{
+		"/dir":   {mzxid: 1, dir: true},
+		"/dir/a": {mzxid: 5, value: "aa"},
+		"/dir/c": {mzxid: 4, value: "c"},
+	}
+	evs := diff(old, new, 6)
+	if len(evs) != 3 {
+		t.Fatalf("test diff failed, %v", evs)
+	}
+	expected := []backend.Event{
+		{Action: backend.ActionCreate, Key: "/dir/c", Value: "c", Index: 4},
+		{Action: backend.ActionSet, Key: "/dir/a", Value: "aa", Index: 5},
+		{Action: backend.ActionDelete, Key: "/dir/b", Index: 6},
+	}
+	for i, ev := range evs {
+		if *ev != expected[i] {
+			t.Fatalf("test diff failed, not expected event, %+v<-->%+v", *ev, expected[i])
+		}
+	}
+}
+
+func TestCreateReadList(t *testing.T) {
+	c := newTestClient(t)
+	defer c.Close()
+
+	c.Delete("/ker-unittest", true)
+	path := "/ker-unittest/dir/file"
+	err := c.Create(path, []byte("unittest1"))
+	if err != nil {
+		t.Fatalf("test Create failed, %v", err)
+	}
+	err = c.Create(path, []byte("unittest1"))
+	if err != backend.ErrNodeExists {
+		t.Fatalf("test Create failed, %v", err)
+	}
+	err = c.Update(path, []byte("unittest2"))
+	if err != nil {
+		t.Fatalf("test Update failed, %v", err)
+	}
+
+	b, err := c.Read(path)
+	if err != nil {
+		t.Fatalf("test read failed, %v", err)
+	}
+	if string(b) != "unittest2" {
+		t.Fatalf("test read failed, not expected data, %s<-->%s", string(b), "unittest2")
+	}
+
+	data, err := c.List("/ker-unittest/dir")
+	if err != nil {
+		t.Fatalf("test list failed, %v", err)
+	}
+	if len(data) != 1 || data[0] != path {
+		t.Fatalf("test list failed, not expected data, %v", data)
+	}
+
+	err = c.Delete("/ker-unittest", true)
+	if err != nil {
+		t.Fatalf("test delete failed, %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	c := newTestClient(t)
+	defer c.Close()
+
+	path := "/ker-unittest/dir"
+	c.Mkdir(path)
+	ch := make(chan *backend.Event, 10)
+	exitCh := make(chan bool)
+	defer close(exitCh)
+	go c.Watch(path, ch, exitCh)
+	time.Sleep(100 * time.Millisecond)
+
+	err := c.Create(path+"/file", []byte("unittest1"))
+	if err != nil {
+		t.Fatalf("test watch failed, %v", err)
+	}
+	select {
+	case ev := <-ch:
+		if ev.Action != backend.ActionCreate || ev.Key != path+"/file" || ev.Value != "unittest1" {
+			t.Fatalf("test watch failed, not expected event, %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("test watch failed, no event")
+	}
+	c.Delete("/ker-unittest", true)
+}